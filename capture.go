@@ -0,0 +1,134 @@
+// capture sink writing mirrored packets to a pcap file
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    PcapMagic       = 0xa1b2c3d4
+    PcapSnapLen     = 65535
+    PcapLinkTypeRaw = 101       // packets start with the IP header
+    PcapHeaderSize  = 24
+    PcapRecordSize  = 16
+)
+
+var ErrCaptureClosed = errors.New("No capture file configured")
+
+/* Local sink of mirrored packets, appended to a pcap file readable by
+   tcpdump or an IDS. Both forwarding loops may mirror to it, and a reload
+   may switch the file, so every write holds the mutex.
+*/
+type Capture struct {
+    mutex   sync.Mutex
+    file    *os.File
+    record  []byte
+    Path    string
+}
+
+func (c *Capture) Init() (error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    return c.open()
+}
+
+// with the mutex held
+func (c *Capture) open() (error) {
+    var err error
+    var info os.FileInfo
+
+    if c.Path == "" {
+        return nil
+    }
+
+    if c.file, err = os.OpenFile(c.Path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600); err != nil {
+        return err
+    }
+
+    if info, err = c.file.Stat(); err != nil {
+        return err
+    }
+
+    // a new file starts with the global header, an existing one is appended to
+    if info.Size() > 0 {
+        return nil
+    }
+
+    header := make([]byte, PcapHeaderSize)
+    binary.LittleEndian.PutUint32(header[0:4], PcapMagic)
+    binary.LittleEndian.PutUint16(header[4:6], 2)
+    binary.LittleEndian.PutUint16(header[6:8], 4)
+    binary.LittleEndian.PutUint32(header[16:20], PcapSnapLen)
+    binary.LittleEndian.PutUint32(header[20:24], PcapLinkTypeRaw)
+
+    _, err = c.file.Write(header)
+    return err
+}
+
+// whether packets sent here are written anywhere
+func (c *Capture) Enabled() bool {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    return c.file != nil
+}
+
+// switch to the file at path, used by reload
+func (c *Capture) Reopen(path string) (error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if c.file != nil {
+        Log(c.file.Close())
+        c.file = nil
+    }
+
+    c.Path = path
+    return c.open()
+}
+
+func (c *Capture) Close() (error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if c.file == nil {
+        return nil
+    }
+
+    err := c.file.Close()
+    c.file = nil
+
+    return err
+}
+
+// nothing is ever received from a capture file
+func (c *Capture) Receive(pkt *Packet) (error) {
+    return nil
+}
+
+func (c *Capture) Send(pkt *Packet) (error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if c.file == nil {
+        return ErrCaptureClosed
+    }
+
+    now := time.Now()
+
+    // header and packet go out in a single write so a reader never sees half a record
+    c.record = append(c.record[:0], make([]byte, PcapRecordSize)...)
+    binary.LittleEndian.PutUint32(c.record[0:4], uint32(now.Unix()))
+    binary.LittleEndian.PutUint32(c.record[4:8], uint32(now.Nanosecond() / 1000))
+    binary.LittleEndian.PutUint32(c.record[8:12], uint32(pkt.Size))
+    binary.LittleEndian.PutUint32(c.record[12:16], uint32(pkt.Size))
+    c.record = append(c.record, pkt.Data[:pkt.Size]...)
+
+    _, err := c.file.Write(c.record)
+    return err
+}
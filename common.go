@@ -1,5 +1,10 @@
 package main
 
+import (
+    "reflect"
+    "sync/atomic"
+)
+
 type NetIO interface {
     Init() (error)
     Close() (error)
@@ -7,23 +12,78 @@ type NetIO interface {
     Send(*Packet) (error)
 }
 
+// implemented by ports whose blocking Receive can be woken up without closing them
+type Interrupter interface {
+    Interrupt() (error)
+}
+
 const (
     NETIO_LOCAL    uint8 = 0
     NETIO_TUNNEL   uint8 = 1
     NETIO_DROP     uint8 = 2
-    NETIO_MAX      uint8 = 3
+    NETIO_CAPTURE  uint8 = 3
+    NETIO_MAX      uint8 = 4
 )
 
+var portNames = [NETIO_MAX]string{"Local", "Tunnel", "Drop", "Capture"}
+
 type Counters struct {
-    Received    uint32
-    Sent        uint32
-    Dropped     uint32
-    ErrReceive  uint32
-    ErrSend     uint32
-    UnSupported uint32
+    Received    uint32  `json:"received"`
+    Sent        uint32  `json:"sent"`
+    Dropped     uint32  `json:"dropped"`
+    ErrReceive  uint32  `json:"err_receive"`
+    ErrSend     uint32  `json:"err_send"`
+    ErrAuth     uint32  `json:"err_auth"`
+    UnSupported uint32  `json:"unsupported"`
+    Replayed    uint32  `json:"replayed"`
+    Disallowed  uint32  `json:"disallowed"`
+    Rejected    uint32  `json:"rejected"`
+    Mirrored    uint32  `json:"mirrored"`
+    Failovers   uint32  `json:"failovers"`
+    Failbacks   uint32  `json:"failbacks"`
+    NoTransit   uint32  `json:"no_transit"`
+    Looped      uint32  `json:"looped"`
+    Expired     uint32  `json:"expired"`
+    Fragmented  uint32  `json:"fragmented"`
+    TooBig      uint32  `json:"too_big"`
+    Clamped     uint32  `json:"clamped"`
 }
 
 type NetworkPort struct {
     netio       NetIO
     counters    Counters
 }
+
+/* Counters are updated from the forwarding loops and the peer monitor while
+   the control server reads them, so every access goes through sync/atomic
+*/
+func count(counter *uint32) {
+    atomic.AddUint32(counter, 1)
+}
+
+// consistent copy of every counter, field by field
+func (c *Counters) Snapshot() (Counters) {
+    var snapshot Counters
+
+    from := reflect.ValueOf(c).Elem()
+    to := reflect.ValueOf(&snapshot).Elem()
+
+    for i := 0; i < from.NumField(); i++ {
+        counter := from.Field(i).Addr().Interface().(*uint32)
+        to.Field(i).SetUint(uint64(atomic.LoadUint32(counter)))
+    }
+
+    return snapshot
+}
+
+// classify a receive error into the matching counter
+func (c *Counters) countReceiveError(err error) {
+    switch err {
+    case ErrTunnelAuth:
+        count(&c.ErrAuth)
+    case ErrTunnelReplay:
+        count(&c.Replayed)
+    default:
+        count(&c.ErrReceive)
+    }
+}
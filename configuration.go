@@ -8,11 +8,14 @@ import (
     "encoding/json"
     "errors"
 	"fmt"
+    "net"
 )
 
 var (
     ErrNoConfigFile = errors.New("Need a config file")
     ErrInConfigFile = errors.New("Error in config file")
+    ErrAddress      = errors.New("Address must be an IP address, with an optional prefix length")
+    ErrPathID       = errors.New("Path ID must be between 1 and 65535")
 )
 
 type EngineConfiguration struct {
@@ -21,15 +24,67 @@ type EngineConfiguration struct {
     Data     string             `json:"data"`
     Key      string             `json:"key"`
     Pubkey   string             `json:"pubkey"`
+    Lookup   string             `json:"lookup,omitempty"`
+    Default  string             `json:"default,omitempty"`
+    Capture  string             `json:"capture,omitempty"`
+    Probe    ProbeFile          `json:"probe"`
+    Rendezvous bool             `json:"rendezvous,omitempty"`  // answer endpoint lookups of peers
+    MaxHops  int                `json:"max_hops,omitempty"`
+    PathID   int                `json:"path_id,omitempty"`   // of relayed packets entering here, derived from the key when 0
+    Address  string             `json:"address,omitempty"`   // of the TUN device with its prefix, source of ICMP errors
+    MTU      int                `json:"mtu,omitempty"`       // of the TUN device and the tunnels
+    PMTUD    bool               `json:"pmtud,omitempty"`     // discover the path MTU of each peer
+    Peers    []PeerEntryFile    `json:"peers"`
     Policies []PolicyEntryFile  `json:"policy"`
 }
 
+type PeerEntryFile struct {
+    Name        string      `json:"name"`
+    Pubkey      string      `json:"pubkey"`
+    Endpoint    string      `json:"endpoint,omitempty"`
+    Allowed     []string    `json:"allowed"`
+    Keepalive   int         `json:"keepalive,omitempty"`   // seconds
+    Rendezvous  string      `json:"rendezvous,omitempty"`  // peer answering endpoint lookups for this one
+    Relay       string      `json:"relay,omitempty"`       // peer relaying while there is no direct session
+}
+
+// liveness probing, zero values take the defaults
+type ProbeFile struct {
+    Interval    int `json:"interval,omitempty"`    // seconds
+    Misses      int `json:"misses,omitempty"`
+    Recover     int `json:"recover,omitempty"`
+}
+
+type NextHopFile struct {
+    Peer        string `json:"peer,omitempty"`
+    Endpoint    string `json:"endpoint,omitempty"`
+    Weight      int    `json:"weight,omitempty"`
+}
+
 type PolicyEntryFile struct {
-    DstSubnet   string `json:"dst"`
-    SrcSubnet   string `json:"src"`
+    Name        string `json:"name,omitempty"`
+    Table       string `json:"table,omitempty"`
+    Priority    int    `json:"priority,omitempty"`
+    DstSubnet   string `json:"dst,omitempty"`
+    SrcSubnet   string `json:"src,omitempty"`
+    Protocol    string `json:"protocol,omitempty"`
+    SrcPort     string `json:"sport,omitempty"`
+    DstPort     string `json:"dport,omitempty"`
+    DSCP        *int   `json:"dscp,omitempty"`
+    ICMPType    *int   `json:"icmp_type,omitempty"`
+    ICMPCode    *int   `json:"icmp_code,omitempty"`
     Action      string `json:"action"`
-    Endpoint    string `json:"endpoint"`
-    ttl         int    `json:"ttl"`
+    Endpoint    string `json:"endpoint,omitempty"`
+    Peer        string `json:"peer,omitempty"`
+    NextHops    []NextHopFile `json:"endpoints,omitempty"`
+    Transit     bool   `json:"transit,omitempty"`
+    MSS         int    `json:"mss,omitempty"`
+    Backup      string `json:"backup,omitempty"`
+    BackupEndpoint string `json:"backup_endpoint,omitempty"`
+    Target      string `json:"target,omitempty"`
+    Reject      string `json:"reject,omitempty"`
+    TTL         int    `json:"ttl,omitempty"`
+    Refresh     bool   `json:"refresh,omitempty"`
 }
 
 type Configuration struct {
@@ -57,6 +112,7 @@ func (c *Configuration) Init() (error) {
 func (c *Configuration) parse() () {
 
     version := flag.Bool("v", false, "Print version")
+    genkey := flag.Bool("g", false, "Generate a key pair")
     configfile := flag.String ("c", "config.json", "Configuration file")
     flag.Parse()
 
@@ -65,6 +121,14 @@ func (c *Configuration) parse() () {
         os.Exit(0)
     }
 
+    if (*genkey) {
+        key, pubkey, err := GenerateKeyPair()
+        Fatal(err)
+        fmt.Println ("key:   ", key)
+        fmt.Println ("pubkey:", pubkey)
+        os.Exit(0)
+    }
+
     c.Filename = *configfile
 }
 
@@ -98,3 +162,45 @@ func (c *Configuration) SaveJSON() (error) {
 
     return nil
 }
+
+// address given as IP/prefix, or as IP for a single host; nil when empty
+func parseAddress(address string) (*net.IPNet, error) {
+    if address == "" {
+        return nil, nil
+    }
+
+    if ip, subnet, err := net.ParseCIDR(address); err == nil {
+        return &net.IPNet{IP: ip, Mask: subnet.Mask}, nil
+    }
+
+    ip := net.ParseIP(address)
+    if ip == nil {
+        return nil, ErrAddress
+    }
+
+    if ip.To4() != nil {
+        return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+    }
+
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// whether the address, an allowed subnet of a peer or a policy subnet is IPv6
+func (c *EngineConfiguration) CarriesIPv6() bool {
+    subnets := []string{c.Address}
+    for _, peer := range c.Peers {
+        subnets = append(subnets, peer.Allowed...)
+    }
+
+    for _, pol := range c.Policies {
+        subnets = append(subnets, pol.SrcSubnet, pol.DstSubnet)
+    }
+
+    for _, subnet := range subnets {
+        if address, err := parseAddress(subnet); err == nil && address != nil && address.IP.To4() == nil {
+            return true
+        }
+    }
+
+    return false
+}
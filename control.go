@@ -0,0 +1,204 @@
+// control plane API served on the configured control address
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+const (
+    ControlAPIVersion = "v1"
+)
+
+var (
+    ErrControlBadRequest = errors.New("Malformed request")
+    ErrControlMethod     = errors.New("Method not allowed")
+)
+
+type ControlServer struct {
+    server  *http.Server
+    engine  *Engine
+    Address string
+}
+
+/* Start serving the control API
+   GET    /v1/counters          counters of every port
+   GET    /v1/policy            policy entries in evaluation order
+   POST   /v1/policy            append a policy entry, or insert it before ?index=
+   DELETE /v1/policy/{index}    delete a policy entry
+   POST   /v1/policy/move       move an entry, {"from": index, "to": index}
+   GET    /v1/peers             peers and their session state
+   POST   /v1/reload            reload the configuration file
+   POST   /v1/shutdown          stop the engine
+*/
+func (c *ControlServer) Init() (error) {
+    var listener net.Listener
+    var err error
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/v1/counters", c.route(map[string]http.HandlerFunc{"GET": c.getCounters}))
+    mux.HandleFunc("/v1/policy", c.route(map[string]http.HandlerFunc{"GET": c.getPolicy, "POST": c.addPolicy}))
+    mux.HandleFunc("/v1/policy/", c.route(map[string]http.HandlerFunc{"DELETE": c.deletePolicy}))
+    mux.HandleFunc("/v1/policy/move", c.route(map[string]http.HandlerFunc{"POST": c.movePolicy}))
+    mux.HandleFunc("/v1/peers", c.route(map[string]http.HandlerFunc{"GET": c.getPeers}))
+    mux.HandleFunc("/v1/reload", c.route(map[string]http.HandlerFunc{"POST": c.reload}))
+    mux.HandleFunc("/v1/shutdown", c.route(map[string]http.HandlerFunc{"POST": c.shutdown}))
+
+    if listener, err = net.Listen("tcp", c.Address); err != nil {
+        return err
+    }
+
+    // the API is not authenticated, anyone reaching it can reconfigure the node
+    if host, _, _ := net.SplitHostPort(c.Address); !net.ParseIP(host).IsLoopback() {
+        Print("Control API on " + c.Address + " is not authenticated, keep it off public addresses")
+    }
+
+    c.server = &http.Server{Handler: mux}
+    go c.server.Serve(listener)
+
+    return nil
+}
+
+func (c *ControlServer) Close() (error) {
+    return c.server.Close()
+}
+
+// dispatch a request to the handler of its method
+func (c *ControlServer) route(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if handler, found := handlers[r.Method]; found {
+            handler(w, r)
+            return
+        }
+
+        writeError(w, http.StatusMethodNotAllowed, ErrControlMethod)
+    }
+}
+
+// last element of the request path, e.g. the index in /v1/policy/3
+func pathArgument(r *http.Request) string {
+    return r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+    writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (c *ControlServer) getCounters(w http.ResponseWriter, r *http.Request) {
+    counters := make(map[string]Counters)
+
+    for index := range c.engine.ports {
+        counters[strings.ToLower(portNames[index])] = c.engine.ports[index].counters.Snapshot()
+    }
+
+    writeJSON(w, http.StatusOK, counters)
+}
+
+func (c *ControlServer) getPolicy(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, c.engine.rules.Entries())
+}
+
+func (c *ControlServer) addPolicy(w http.ResponseWriter, r *http.Request) {
+    var pol PolicyEntryFile
+    var err error
+
+    index := -1
+    if value := r.URL.Query().Get("index"); value != "" {
+        if index, err = strconv.Atoi(value); err != nil {
+            writeError(w, http.StatusBadRequest, ErrControlBadRequest)
+            return
+        }
+    }
+
+    if err = json.NewDecoder(r.Body).Decode(&pol); err != nil {
+        writeError(w, http.StatusBadRequest, ErrControlBadRequest)
+        return
+    }
+
+    err = c.engine.rules.InsertCompiled(index, pol.Name, func() (*PolicyEntry, error) {
+        return c.engine.compileEntry(pol)
+    })
+
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, pol)
+}
+
+func (c *ControlServer) movePolicy(w http.ResponseWriter, r *http.Request) {
+    var move struct {
+        From int `json:"from"`
+        To   int `json:"to"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&move); err != nil {
+        writeError(w, http.StatusBadRequest, ErrControlBadRequest)
+        return
+    }
+
+    if err := c.engine.rules.Move(move.From, move.To); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, c.engine.rules.Entries())
+}
+
+func (c *ControlServer) deletePolicy(w http.ResponseWriter, r *http.Request) {
+    var index int
+    var err error
+
+    // entries are addressed by index or by name
+    argument := pathArgument(r)
+    if index, err = strconv.Atoi(argument); err != nil {
+        err = c.engine.rules.DeleteByName(argument)
+    } else {
+        err = c.engine.rules.Delete(index)
+    }
+
+    if err != nil {
+        writeError(w, http.StatusNotFound, err)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ControlServer) getPeers(w http.ResponseWriter, r *http.Request) {
+    peers := []PeerInfo{}
+
+    for _, peer := range c.engine.peers.List() {
+        peers = append(peers, peer.Info())
+    }
+
+    writeJSON(w, http.StatusOK, peers)
+}
+
+func (c *ControlServer) reload(w http.ResponseWriter, r *http.Request) {
+    if err := c.engine.Reload(); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, c.engine.rules.Entries())
+}
+
+// the response is sent before the engine goes away
+func (c *ControlServer) shutdown(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusAccepted)
+    w.(http.Flusher).Flush()
+
+    go c.engine.Shutdown()
+}
@@ -0,0 +1,118 @@
+// cryptographic primitives used by the tunnel
+package main
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdh"
+    "crypto/hkdf"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+)
+
+const (
+    KeySize     = 32
+    NonceSize   = 12
+    TagSize     = 16
+)
+
+var (
+    ErrCryptoInvalidKey    = errors.New("Invalid key")
+    ErrCryptoNonceExceeded = errors.New("Nonce counter exhausted")
+)
+
+// parse a base64 encoded X25519 private key
+func ParsePrivateKey(key string) (*ecdh.PrivateKey, error) {
+    var raw []byte
+    var err error
+
+    if raw, err = base64.StdEncoding.DecodeString(key); err != nil || len(raw) != KeySize {
+        return nil, ErrCryptoInvalidKey
+    }
+
+    return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// parse a base64 encoded X25519 public key
+func ParsePublicKey(key string) (*ecdh.PublicKey, error) {
+    var raw []byte
+    var err error
+
+    if raw, err = base64.StdEncoding.DecodeString(key); err != nil || len(raw) != KeySize {
+        return nil, ErrCryptoInvalidKey
+    }
+
+    return ecdh.X25519().NewPublicKey(raw)
+}
+
+// base64 encoding of a public key, as used in the configuration
+func EncodePublicKey(key *ecdh.PublicKey) string {
+    return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// generate a new key pair, both base64 encoded
+func GenerateKeyPair() (string, string, error) {
+    var key *ecdh.PrivateKey
+    var err error
+
+    if key, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+        return "", "", err
+    }
+
+    return base64.StdEncoding.EncodeToString(key.Bytes()), EncodePublicKey(key.PublicKey()), nil
+}
+
+// AES-256-GCM keyed with a 32 byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+    var block cipher.Block
+    var err error
+
+    if block, err = aes.NewCipher(key); err != nil {
+        return nil, err
+    }
+
+    return cipher.NewGCM(block)
+}
+
+// nonce is the 4 byte index followed by the 8 byte counter
+func makeNonce(nonce []byte, index uint32, counter uint64) {
+    binary.BigEndian.PutUint32(nonce[0:4], index)
+    binary.BigEndian.PutUint64(nonce[4:12], counter)
+}
+
+// HKDF-SHA256 keyed by the chaining key, returning n keys
+func kdf(chain []byte, input []byte, n int) ([][]byte, error) {
+    var material []byte
+    var err error
+
+    if material, err = hkdf.Key(sha256.New, input, chain, "", n*KeySize); err != nil {
+        return nil, err
+    }
+
+    keys := make([][]byte, n)
+    for i := range keys {
+        keys[i] = material[i*KeySize : (i+1)*KeySize]
+    }
+
+    return keys, nil
+}
+
+/* Path identifier of the node with key, stamped on the packets entering the
+   tunnels there. Derived from the static key, it is the same across restarts
+   and can be worked out by the other nodes; 0 is left to keepalives.
+*/
+func pathID(key *ecdh.PublicKey) uint16 {
+    sum := sha256.Sum256(key.Bytes())
+    return max(binary.BigEndian.Uint16(sum[:2]), 1)
+}
+
+// random 32 bit value, used for session indices
+func randomUint32() (uint32) {
+    var value [4]byte
+
+    rand.Read(value[:])
+    return binary.BigEndian.Uint32(value[:])
+}
@@ -0,0 +1,372 @@
+// ctl subcommand: command-line client of the control API
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+var (
+    ErrCtlUsage = errors.New("Unknown command")
+    ErrCtlField = errors.New("Unknown or unsupported field")
+)
+
+const ctlUsage = `Usage: wirelay ctl [-a address] [-c config] [-j] command
+
+Commands:
+  show counters             counters of every port
+  show policy               policy entries of every table in evaluation order
+  policy add key=value...   append a policy entry, e.g. dst=10.0.0.0/8 action=FORWARD peer=shiraz
+  policy insert index key=value...
+                            insert a policy entry before index
+                            list fields take JSON, e.g. endpoints='[{"peer":"shiraz","weight":2}]'
+  policy del index|name     delete the policy entry at index or with that name
+  policy move from to       move the policy entry at from to index to
+  peer list                 peers and their session state
+  reload                    reload the configuration file
+  shutdown                  stop the engine
+`
+
+type CtlClient struct {
+    client  http.Client
+    base    string
+    raw     bool
+}
+
+// run the ctl subcommand and return the process exit code
+func Ctl(args []string) int {
+    var err error
+
+    flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+    address := flags.String("a", "", "Control address, read from the configuration file if empty")
+    configfile := flags.String("c", "config.json", "Configuration file")
+    raw := flags.Bool("j", false, "Print raw JSON")
+    flags.Usage = func() { fmt.Fprint(os.Stderr, ctlUsage) }
+
+    if err = flags.Parse(args); err != nil {
+        return 2
+    }
+
+    if *address == "" {
+        conf := Configuration{Filename: *configfile}
+        if err = conf.ReadJSON(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+
+        *address = conf.content.Control
+    }
+
+    c := CtlClient{client: http.Client{Timeout: 5 * time.Second}, base: controlURL(*address), raw: *raw}
+    if err = c.Run(flags.Args()); err != nil {
+        if err == ErrCtlUsage {
+            flags.Usage()
+            return 2
+        }
+
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    return 0
+}
+
+// a wildcard listen address is reached through the loopback
+func controlURL(address string) string {
+    host, port, err := net.SplitHostPort(address)
+    if err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+        address = net.JoinHostPort("127.0.0.1", port)
+    }
+
+    return "http://" + address + "/" + ControlAPIVersion
+}
+
+func (c *CtlClient) Run(args []string) (error) {
+    command := strings.Join(args, " ")
+
+    switch {
+    case command == "show counters":
+        return c.showCounters()
+    case command == "show policy":
+        return c.showPolicy()
+    case len(args) > 2 && args[0] == "policy" && args[1] == "add":
+        return c.addPolicy("", args[2:])
+    case len(args) > 3 && args[0] == "policy" && args[1] == "insert":
+        return c.addPolicy(args[2], args[3:])
+    case len(args) == 4 && args[0] == "policy" && args[1] == "move":
+        return c.movePolicy(args[2], args[3])
+    case len(args) == 3 && args[0] == "policy" && args[1] == "del":
+        return c.request("DELETE", "/policy/" + args[2], nil, nil)
+    case command == "peer list":
+        return c.listPeers()
+    case command == "reload":
+        return c.request("POST", "/reload", nil, nil)
+    case command == "shutdown":
+        return c.request("POST", "/shutdown", nil, nil)
+    }
+
+    return ErrCtlUsage
+}
+
+// perform a request, decoding the response into result unless raw output is asked for
+func (c *CtlClient) request(method string, path string, body any, result any) (error) {
+    var payload io.Reader
+    var request *http.Request
+    var response *http.Response
+    var content []byte
+    var err error
+
+    if body != nil {
+        if content, err = json.Marshal(body); err != nil {
+            return err
+        }
+
+        payload = bytes.NewReader(content)
+    }
+
+    if request, err = http.NewRequest(method, c.base + path, payload); err != nil {
+        return err
+    }
+
+    if response, err = c.client.Do(request); err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if content, err = io.ReadAll(response.Body); err != nil {
+        return err
+    }
+
+    if response.StatusCode >= 300 {
+        var failure map[string]string
+        if json.Unmarshal(content, &failure) == nil && failure["error"] != "" {
+            return errors.New(failure["error"])
+        }
+
+        return errors.New(response.Status)
+    }
+
+    if c.raw {
+        os.Stdout.Write(content)
+        return nil
+    }
+
+    if result != nil {
+        return json.Unmarshal(content, result)
+    }
+
+    return nil
+}
+
+func (c *CtlClient) showCounters() (error) {
+    var counters map[string]Counters
+
+    if err := c.request("GET", "/counters", nil, &counters); err != nil || c.raw {
+        return err
+    }
+
+    names := make([]string, 0, len(counters))
+    for name := range counters {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "PORT\tRECEIVED\tSENT\tDROPPED\tUNSUPPORTED\tERR RX\tERR TX\tERR AUTH\tREPLAYED\tDISALLOWED\tREJECTED\tMIRRORED\tFAILOVERS\tFAILBACKS\tNO TRANSIT\tLOOPED\tEXPIRED\tFRAGMENTED\tTOO BIG\tCLAMPED")
+    for _, name := range names {
+        entry := counters[name]
+        fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name,
+            entry.Received, entry.Sent, entry.Dropped, entry.UnSupported,
+            entry.ErrReceive, entry.ErrSend, entry.ErrAuth, entry.Replayed, entry.Disallowed, entry.Rejected,
+            entry.Mirrored, entry.Failovers, entry.Failbacks, entry.NoTransit, entry.Looped, entry.Expired, entry.Fragmented, entry.TooBig, entry.Clamped)
+    }
+
+    return w.Flush()
+}
+
+func (c *CtlClient) showPolicy() (error) {
+    var entries []PolicyView
+
+    if err := c.request("GET", "/policy", nil, &entries); err != nil || c.raw {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "TABLE\tINDEX\tPRIO\tNAME\tSRC\tDST\tMATCH\tACTION\tPEER")
+    for _, entry := range entries {
+        match, _ := CompileTransportMatch(entry.PolicyEntryFile)
+
+        table := entry.Table
+        if table == "" {
+            table = PolicyMainTable
+        }
+
+        fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", table, entry.Index, entry.Priority, entry.Name,
+            orAny(entry.SrcSubnet), orAny(entry.DstSubnet), orAny(match.String()), entry.Action,
+            entry.Peer + entry.Endpoint + entry.Target + nextHops(entry.NextHops) + backup(entry.PolicyEntryFile))
+    }
+
+    return w.Flush()
+}
+
+// build the entry from key=value pairs named after the configuration fields
+func (c *CtlClient) addPolicy(index string, args []string) (error) {
+    var entry PolicyEntryFile
+
+    for _, arg := range args {
+        key, value, found := strings.Cut(arg, "=")
+        if !found {
+            return ErrCtlUsage
+        }
+
+        if err := setConfigField(&entry, key, value); err != nil {
+            return errors.New(key + ": " + err.Error())
+        }
+    }
+
+    path := "/policy"
+    if index != "" {
+        if _, err := strconv.Atoi(index); err != nil {
+            return ErrCtlUsage
+        }
+
+        path = path + "?index=" + index
+    }
+
+    return c.request("POST", path, entry, nil)
+}
+
+func (c *CtlClient) movePolicy(from string, to string) (error) {
+    var move struct {
+        From int `json:"from"`
+        To   int `json:"to"`
+    }
+    var err error
+
+    if move.From, err = strconv.Atoi(from); err != nil {
+        return ErrCtlUsage
+    }
+
+    if move.To, err = strconv.Atoi(to); err != nil {
+        return ErrCtlUsage
+    }
+
+    return c.request("POST", "/policy/move", move, nil)
+}
+
+func (c *CtlClient) listPeers() (error) {
+    var peers []PeerInfo
+
+    if err := c.request("GET", "/peers", nil, &peers); err != nil || c.raw {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "NAME\tENDPOINT\tALLOWED\tSESSION\tDOWN\tHANDSHAKES\tLAST HANDSHAKE")
+    for _, peer := range peers {
+        last := "never"
+        if !peer.LastHandshake.IsZero() {
+            last = time.Since(peer.LastHandshake).Round(time.Second).String() + " ago"
+        }
+
+        fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%d\t%s\n", peer.Name, orAny(peer.Endpoint),
+            strings.Join(peer.Allowed, ","), peer.Session, peer.Down, peer.Handshakes, last)
+    }
+
+    return w.Flush()
+}
+
+// set the field of a configuration struct whose json name is key;
+// repeating the key of a list field appends to it
+func setConfigField(config any, key string, value string) (error) {
+    var err error
+    var number int
+    var flag bool
+
+    fields := reflect.ValueOf(config).Elem()
+    for index := 0; index < fields.NumField(); index++ {
+        name, _, _ := strings.Cut(fields.Type().Field(index).Tag.Get("json"), ",")
+        if name != key {
+            continue
+        }
+
+        field := fields.Field(index)
+        switch {
+        case field.Kind() == reflect.String:
+            field.SetString(value)
+
+        case field.Kind() == reflect.Bool:
+            if flag, err = strconv.ParseBool(value); err == nil {
+                field.SetBool(flag)
+            }
+
+        case field.Kind() == reflect.Int:
+            if number, err = strconv.Atoi(value); err == nil {
+                field.SetInt(int64(number))
+            }
+
+        case field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Int:
+            if number, err = strconv.Atoi(value); err == nil {
+                field.Set(reflect.ValueOf(&number))
+            }
+
+        case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+            field.Set(reflect.Append(field, reflect.ValueOf(value)))
+
+        // structured fields are given as JSON
+        case field.Kind() == reflect.Slice:
+            err = json.Unmarshal([]byte(value), field.Addr().Interface())
+
+        default:
+            return ErrCtlField
+        }
+
+        return err
+    }
+
+    return ErrCtlField
+}
+
+// next hops as peer or endpoint, with the weight when it is not 1
+func nextHops(hops []NextHopFile) string {
+    names := []string{}
+    for _, hop := range hops {
+        name := hop.Peer + hop.Endpoint
+        if hop.Weight > 1 {
+            name = name + "*" + strconv.Itoa(hop.Weight)
+        }
+
+        names = append(names, name)
+    }
+
+    return strings.Join(names, ",")
+}
+
+func backup(entry PolicyEntryFile) string {
+    if entry.Backup == "" && entry.BackupEndpoint == "" {
+        return ""
+    }
+
+    return " (backup " + entry.Backup + entry.BackupEndpoint + ")"
+}
+
+func orAny(value string) string {
+    if value == "" {
+        return "*"
+    }
+
+    return value
+}
@@ -0,0 +1,157 @@
+// load balancing flows over several weighted next hops
+package main
+
+import (
+    "errors"
+    "math"
+    "strconv"
+)
+
+const (
+    fnvOffset = 14695981039346656037
+    fnvPrime  = 1099511628211
+)
+
+var (
+    ErrNextHopWeight = errors.New("Next hop weight must be positive")
+    ErrNextHopAction = errors.New("Endpoints need the FORWARD action")
+)
+
+type NextHop struct {
+    peer    *Peer
+    weight  float64
+    seed    uint64      // hash of the hop identity, independent of its position
+}
+
+/* Weighted rendezvous hashing over the next hops of a FORWARD entry.
+   Every flow scores each hop from the hash of its 5-tuple and the hop
+   seed, and goes to the best scoring hop that is not down. A flow stays
+   on its hop for as long as that hop is up, and when a hop goes down or
+   comes back only the flows of that hop move.
+*/
+type NextHopGroup struct {
+    hops []NextHop
+}
+
+func CompileNextHops(hops []NextHopFile, peers *Peers, register bool) (*NextHopGroup, error) {
+    var peer *Peer
+    var err error
+
+    group := &NextHopGroup{}
+    for _, hop := range hops {
+        if peer, err = resolvePeer(hop.Peer, hop.Endpoint, peers, register); err != nil {
+            return nil, err
+        }
+
+        if peer == nil {
+            return nil, ErrPolicyNoPeer
+        }
+
+        weight := hop.Weight
+        if weight == 0 {
+            weight = 1
+        }
+
+        if weight < 0 {
+            return nil, ErrNextHopWeight
+        }
+
+        seed := fnv1a(fnvOffset, []byte(hop.Peer + "/" + hop.Endpoint))
+        group.hops = append(group.hops, NextHop{peer: peer, weight: float64(weight), seed: seed})
+    }
+
+    return group, nil
+}
+
+// hop of the flow of pkt; when every hop is down they are all candidates,
+// so traffic keeps triggering handshakes
+func (g *NextHopGroup) Select(pkt *Packet) *Peer {
+    var best *Peer
+    var bestScore float64
+
+    flow := pkt.FlowHash()
+
+    for pass := 0; pass < 2 && best == nil; pass++ {
+        for _, hop := range g.hops {
+            if pass == 0 && hop.peer.Down() {
+                continue
+            }
+
+            // uniform in (0, 1) from the 53 high bits of the mixed hash
+            u := (float64(mix64(flow ^ hop.seed) >> 11) + 0.5) / (1 << 53)
+            score := hop.weight / -math.Log(u)
+
+            if best == nil || score > bestScore {
+                best, bestScore = hop.peer, score
+            }
+        }
+    }
+
+    return best
+}
+
+// the peers of the group, in configuration order
+func (g *NextHopGroup) Peers() []*Peer {
+    peers := make([]*Peer, 0, len(g.hops))
+    for _, hop := range g.hops {
+        peers = append(peers, hop.peer)
+    }
+
+    return peers
+}
+
+func (g *NextHopGroup) String() string {
+    output := "ecmp"
+    for _, hop := range g.hops {
+        output = output + " " + hop.peer.String()
+        if hop.weight != 1 {
+            output = output + "*" + strconv.Itoa(int(hop.weight))
+        }
+    }
+
+    return output
+}
+
+/* FNV-1a over addresses, protocol and ports. Ports are left out when absent
+   and for every fragment, as only the first one has them and all the
+   fragments of a datagram must take the same next hop.
+*/
+func (pkt *Packet) FlowHash() uint64 {
+    addresses := pkt.Data[12:20]
+    if pkt.IsIPv6() {
+        addresses = pkt.Data[8:40]
+    }
+
+    flow := fnv1a(fnvOffset, addresses)
+    flow = fnv1a(flow, []byte{pkt.Protocol()})
+
+    if pkt.Fragmented() {
+        return flow
+    }
+
+    if src, dst, ok := pkt.Ports(); ok {
+        flow = fnv1a(flow, []byte{byte(src >> 8), byte(src), byte(dst >> 8), byte(dst)})
+    }
+
+    return flow
+}
+
+func fnv1a(hash uint64, data []byte) uint64 {
+    for _, b := range data {
+        hash ^= uint64(b)
+        hash *= fnvPrime
+    }
+
+    return hash
+}
+
+// splitmix64 finalizer
+func mix64(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+
+    return x
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+)
+
+func TestNextHopGroup(t *testing.T) {
+    a, b, c := &Peer{name: "a"}, &Peer{name: "b"}, &Peer{name: "c"}
+    group := &NextHopGroup{hops: []NextHop{
+        {peer: a, weight: 1, seed: fnv1a(fnvOffset, []byte("a"))},
+        {peer: b, weight: 1, seed: fnv1a(fnvOffset, []byte("b"))},
+        {peer: c, weight: 2, seed: fnv1a(fnvOffset, []byte("c"))},
+    }}
+
+    flows := make([]*Packet, 4000)
+    selected := make([]*Peer, len(flows))
+    count := make(map[*Peer]int)
+
+    for index := range flows {
+        flows[index] = testPacket("10.0.0.1", net.IPv4(10, 1, byte(index >> 8), byte(index)).String())
+        selected[index] = group.Select(flows[index])
+        count[selected[index]]++
+    }
+
+    // weights are followed within a few percent
+    if count[c] < 1800 || count[c] > 2200 || count[a] < 800 || count[a] > 1200 {
+        t.Errorf("unbalanced %d %d %d", count[a], count[b], count[c])
+    }
+
+    // only the flows of a hop that goes down move
+    b.down = true
+    for index, pkt := range flows {
+        hop := group.Select(pkt)
+        if hop == b || (selected[index] != b && hop != selected[index]) {
+            t.Fatalf("flow %d moved from %s to %s", index, selected[index].name, hop.name)
+        }
+    }
+
+    // with every hop down the flows keep their hop
+    a.down, c.down = true, true
+    for index, pkt := range flows {
+        if hop := group.Select(pkt); hop != selected[index] {
+            t.Fatalf("flow %d moved from %s to %s", index, selected[index].name, hop.name)
+        }
+    }
+}
+
+func TestFlowHashFragments(t *testing.T) {
+    pkt := testPacket("10.0.0.1", "10.1.0.1")
+    pkt.Data[9] = 17
+    pkt.Data = append(pkt.Data, make([]byte, 3000)...)
+    pkt.Data[20], pkt.Data[21], pkt.Data[22], pkt.Data[23] = 0x30, 0x39, 0x00, 0x35
+    pkt.Size = uint16(len(pkt.Data))
+    binary.BigEndian.PutUint16(pkt.Data[2:4], pkt.Size)
+
+    flow := pkt.FlowHash()
+
+    // every fragment of the datagram hashes alike, without the ports only the first has
+    hashes := []uint64{}
+    frag := &Packet{Data: make([]byte, 2000)}
+    err := Fragment(pkt, 1000, frag, func(frag *Packet) error {
+        hashes = append(hashes, frag.FlowHash())
+        return nil
+    })
+
+    if err != nil || len(hashes) != 4 {
+        t.Fatalf("%d fragments, %v", len(hashes), err)
+    }
+
+    for index, hash := range hashes {
+        if hash != hashes[0] {
+            t.Errorf("fragment %d hashed apart", index)
+        }
+    }
+
+    if flow == hashes[0] {
+        t.Error("ports left out of an unfragmented datagram")
+    }
+}
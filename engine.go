@@ -1,17 +1,33 @@
 package main
 
 import (
+    "context"
+    "fmt"
+    "net"
+    "strconv"
     "sync"
 	"os"
 	"os/signal"
 	"syscall"
 	"log"
+	"time"
 )
 
 type Engine struct {
     conf    Configuration
     ports   [NETIO_MAX]NetworkPort
     rules   Policy
+    icmp    RateLimiter
+    route   Route       // stamped on packets entering the tunnels here
+    loops   RateLimiter // of the looped packets logged
+    address net.IP      // source of time exceeded errors, nil to answer from the destination
+    mtu     int         // largest packet sent into the tunnels unfragmented
+    peers   Peers
+    control ControlServer
+    reload  sync.Mutex
+    tasks   sync.WaitGroup  // background goroutines, stopped with the context
+    ctx     context.Context
+    cancel  context.CancelFunc
 }
 
 /* Initilizing the Wirelay Engine
@@ -21,17 +37,45 @@ type Engine struct {
 */
 func (e *Engine) Init() (error) {
     var err   error
+    var entry *PolicyEntry
+    var address *net.IPNet
 
     err = e.conf.Init()
     Fatal(err)
 
+    e.ctx, e.cancel = context.WithCancel(context.Background())
+
+    if address, err = parseAddress(e.conf.content.Address); err != nil {
+        return err
+    }
+
+    if address != nil {
+        e.address = address.IP
+    }
+
+    e.mtu = DefaultMTU
+    if e.conf.content.MTU != 0 {
+        e.mtu = e.conf.content.MTU
+    }
+
+    if err = checkMTU(e.mtu, &e.conf.content); err != nil {
+        return err
+    }
+
     // Create local TUN interface
-    e.ports[NETIO_LOCAL].netio = &TunTap{Name: e.conf.content.Name}
+    e.ports[NETIO_LOCAL].netio = &TunTap{Name: e.conf.content.Name, Address: address, MTU: e.mtu}
     if err = e.ports[NETIO_LOCAL].netio.Init(); err != nil {
         return err
     }
 
-    e.ports[NETIO_TUNNEL].netio = &UDPSocket{LocalSocket: e.conf.content.Data}
+    if err = e.peers.Init(e.conf.content.Key, e.conf.content.Pubkey, e.conf.content.Peers); err != nil {
+        return err
+    }
+
+    probe := compileProbe(e.conf.content.Probe)
+    e.ports[NETIO_TUNNEL].netio = &UDPSocket{LocalSocket: e.conf.content.Data, Peers: &e.peers,
+        ProbeMisses: probe.misses, ProbeRecover: probe.recover, MTU: e.mtu, DontFragment: e.conf.content.PMTUD,
+        Rendezvous: e.conf.content.Rendezvous}
     if err = e.ports[NETIO_TUNNEL].netio.Init(); err != nil {
         return err
     }
@@ -41,9 +85,69 @@ func (e *Engine) Init() (error) {
         return err
     }
 
+    e.ports[NETIO_CAPTURE].netio = &Capture{Path: e.conf.content.Capture}
+    if err = e.ports[NETIO_CAPTURE].netio.Init(); err != nil {
+        return err
+    }
+
+    if err = e.rules.SetLookup(e.conf.content.Lookup); err != nil {
+        return err
+    }
+
+    if err = e.rules.SetDefault(e.conf.content.Default); err != nil {
+        return err
+    }
+
+    e.icmp = RateLimiter{Rate: ICMPRate, Burst: ICMPBurst}
+
+    e.loops = RateLimiter{Rate: LoopLogRate, Burst: 1}
+
+    e.route = Route{Hops: TunnelMaxHops, Path: pathID(e.peers.key.PublicKey())}
+    if e.conf.content.MaxHops > 0 && e.conf.content.MaxHops <= 255 {
+        e.route.Hops = uint8(e.conf.content.MaxHops)
+    }
+
+    if e.conf.content.PathID != 0 {
+        if e.conf.content.PathID < 1 || e.conf.content.PathID > 65535 {
+            return ErrPathID
+        }
+
+        e.route.Path = uint16(e.conf.content.PathID)
+    }
+
+    // packets entering the tunnels at a peer with the same ID would be dropped here as looped
+    for _, peer := range e.peers.List() {
+        if !peer.anonymous && pathID(peer.remote) == e.route.Path {
+            Print("Path ID " + strconv.Itoa(int(e.route.Path)) + " is the one derived for peer " + peer.name +
+                ", set a unique path_id on one of them")
+        }
+    }
+
+    // compile everything first so the rules are published once
+    rules := []*PolicyEntry{}
     for _, pol := range e.conf.content.Policies {
-        if err = e.rules.CompilePolicy(pol); err != nil {
+        if entry, err = e.compileEntry(pol); err != nil {
             Log(err)
+            continue
+        }
+
+        rules = append(rules, entry)
+    }
+    e.rules.Replace(rules)
+
+    e.tasks.Go(e.reapPolicies)
+    e.tasks.Go(func() { e.monitorPeers(probe.interval) })
+    e.tasks.Go(e.punchHoles)
+    e.tasks.Go(e.syncRoutes)
+
+    if e.conf.content.PMTUD {
+        e.tasks.Go(e.discoverPathMTU)
+    }
+
+    if e.conf.content.Control != "" {
+        e.control = ControlServer{Address: e.conf.content.Control, engine: e}
+        if err = e.control.Init(); err != nil {
+            return err
         }
     }
 
@@ -56,86 +160,452 @@ func (e *Engine) Init() (error) {
 }
 
 // signal handler for Interrupt, Terminate, and SIGHUP
-func (e *Engine) signalHandler(signal chan os.Signal) {
+func (e *Engine) signalHandler(sigs chan os.Signal) {
+    defer signal.Stop(sigs)
+
     for {
-        sig := <-signal
+        var sig os.Signal
+
+        select {
+        case <-e.ctx.Done():
+            return
+        case sig = <-sigs:
+        }
+
         switch sig {
         case syscall.SIGUSR1:
             e.PrintCounters()
+            e.peers.DumpSessions()
         case syscall.SIGUSR2:
             e.rules.DumpPolicies()
         case os.Interrupt, syscall.SIGTERM:
-            Print("Shutting down")
-            os.Exit(0)
-            // TODO: use channel to shutdown gracefully
+            e.Shutdown()
         case syscall.SIGHUP:
-            // TODO: reload configuration from config file and refresh all connections  
             Print("Reloading configuration")
+            Log(e.Reload())
         }
     }
 }
 
+// compile pol against the peers, ports and MTU of the engine; a mirror to a
+// capture port without a file could never write anything
+func (e *Engine) compileEntry(pol PolicyEntryFile) (*PolicyEntry, error) {
+    if e.mtu < MinMTUIPv6 && (&EngineConfiguration{Policies: []PolicyEntryFile{pol}}).CarriesIPv6() {
+        return nil, ErrMTUIPv6
+    }
+
+    if pol.Action == "MIRROR" && pol.Peer == "" && pol.Endpoint == "" && !e.capturing() {
+        return nil, ErrPolicyNoCapture
+    }
+
+    return CompileEntry(pol, &e.peers)
+}
+
+func (e *Engine) capturing() bool {
+    return e.ports[NETIO_CAPTURE].netio.(*Capture).Enabled()
+}
+
+/* Run the dataplane until Shutdown is called
+   1 - Forward on the local and tunnel ports until the context is cancelled
+       and wait for the background goroutines to stop
+   2 - Close the control server and every port
+   3 - Print the final counters
+*/
 func (e *Engine) Start() {
     var waitGroup sync.WaitGroup
 
 	Print("Starting wirelay dataplane")
 
+    waitGroup.Add(2)
     go e.Forward(&e.ports[NETIO_LOCAL], &waitGroup)
     go e.Forward(&e.ports[NETIO_TUNNEL], &waitGroup)
-    waitGroup.Add(2)
 
 	waitGroup.Wait()
-	Print("Shuting down")
+
+    // nothing may use the ports once they are closed
+    e.tasks.Wait()
+
+    if e.control.server != nil {
+        Log(e.control.Close())
+    }
+
+    for index := range e.ports {
+        Log(e.ports[index].netio.Close())
+    }
+
+    e.PrintCounters()
+	Print("Dataplane stopped")
 }
 
 func (e *Engine) Forward(dev *NetworkPort, waitGroup *sync.WaitGroup) {
-    var pkt Packet
+    var pkt, reply, frag Packet
     var action PolicyAction
     var found bool
 
-   // TODO: set MTU and read correct number of bytes
-    pkt.Data = make([]byte, 2000)
+    mirrors := make([]PolicyAction, 0, 4)
+
+    // packets from the tunnels may be larger than the local MTU
+    pkt.Data = make([]byte, MaxPacketSize)
+    reply.Data = make([]byte, MaxPacketSize)
+    frag.Data = make([]byte, MaxPacketSize)
 
     defer waitGroup.Done()
     for {
+        // the packet in flight is always forwarded before stopping
+        if e.ctx.Err() != nil {
+            return
+        }
+
         if err := dev.netio.Receive(&pkt); err != nil {
-            dev.counters.ErrReceive++
+            if e.ctx.Err() != nil {
+                return
+            }
+
+            dev.counters.countReceiveError(err)
+            continue
+        }
+
+        count(&dev.counters.Received)
+
+        if !pkt.IsIPv4() && !pkt.IsIPv6() {
+            count(&dev.counters.UnSupported)
+            continue
+        }
+
+        // packets from a peer must come from its allowed subnets
+        if pkt.Peer != nil && !pkt.Peer.Allows(pkt.GetSource()) {
+            count(&dev.counters.Disallowed)
+            continue
+        }
+
+        mirrors = mirrors[:0]
+        action, found = e.rules.LookupMirrors(&pkt, &mirrors)
+        for _, mirror := range mirrors {
+            e.mirror(dev, &pkt, &frag, mirror)
+        }
+
+        if action.reject != RejectNone {
+            e.reject(dev, &pkt, &reply, action.reject)
             continue
         }
 
-        dev.counters.Received++
+        if !found {
+            count(&dev.counters.Dropped)
+            continue
+        }
 
-        if !pkt.IsIPv4() {
-            dev.counters.UnSupported++
+        if action.egress == NETIO_TUNNEL && !e.transit(dev, &pkt, action) {
             continue
         }
 
-        if action, found = e.rules.Lookup(&pkt); !found {
-            dev.counters.Dropped++
+        // routed into the tunnels, the inner packet loses a hop
+        if action.egress == NETIO_TUNNEL && !pkt.DecrementTTL() {
+            e.expire(dev, &pkt, &reply)
+            continue
+        }
+
+        pkt.Target = action.peer
+        if action.group != nil {
+            pkt.Target = action.group.Select(&pkt)
+        } else if action.failover != nil {
+            pkt.Target = action.failover.Active()
+        }
+
+        if action.mss != 0 && pkt.ClampMSS(action.mss) {
+            count(&dev.counters.Clamped)
+        }
+
+        if mtu := e.pathMTU(pkt.Target); action.egress == NETIO_TUNNEL && int(pkt.Size) > mtu {
+            e.tooBig(dev, &pkt, &reply, &frag, mtu)
             continue
         }
 
-        pkt.Endpoint = action.endpoint
         if err := e.ports[action.egress].netio.Send(&pkt); err != nil {
-            dev.counters.ErrSend++
+            count(&dev.counters.ErrSend)
             continue
         }
 
-        dev.counters.Sent++
+        count(&dev.counters.Sent)
+    }
+}
+
+/* Set the route of a packet going to the tunnel
+   Packets from the local port start with the full hop limit. Packets from
+   the tunnel need an entry permitting transit, lose a hop, and are dropped
+   once out of hops or back at the node they entered the tunnels at.
+*/
+func (e *Engine) transit(dev *NetworkPort, pkt *Packet, action PolicyAction) bool {
+    if pkt.Peer == nil {
+        pkt.Route = e.route
+        return true
+    }
+
+    if !action.transit {
+        count(&dev.counters.NoTransit)
+        return false
+    }
+
+    if pkt.Route.Hops <= 1 || pkt.Route.Path == e.route.Path {
+        count(&dev.counters.Looped)
+
+        // a packet with our path ID but hops left is a loop or another node with the same ID
+        if pkt.Route.Path == e.route.Path && e.loops.Allow(time.Now()) {
+            Print("Packet from peer " + pkt.Peer.String() + " dropped, it entered the tunnels with path ID " +
+                strconv.Itoa(int(e.route.Path)) + " of this node")
+        }
+
+        return false
+    }
+
+    pkt.Route.Hops--
+    return true
+}
+
+// send a copy of pkt to the mirror peer or the capture port, as a packet entering the tunnels here
+func (e *Engine) mirror(dev *NetworkPort, pkt *Packet, frag *Packet, mirror PolicyAction) {
+    var err error
+
+    route := pkt.Route
+    defer func() { pkt.Route = route }()
+
+    pkt.Target, pkt.Route = mirror.peer, e.route
+
+    // copies over the path MTU are fragmented like forwarded packets, but
+    // dropped without a too big error, which would shrink the packets of
+    // the sender for a copy it does not know about
+    mtu := e.pathMTU(mirror.peer)
+    switch {
+    case mirror.egress != NETIO_TUNNEL || int(pkt.Size) <= mtu:
+        err = e.ports[mirror.egress].netio.Send(pkt)
+    case pkt.DontFragment():
+        count(&dev.counters.TooBig)
+        return
+    default:
+        err = Fragment(pkt, mtu, frag, e.ports[NETIO_TUNNEL].netio.Send)
+    }
+
+    if err != nil {
+        count(&dev.counters.ErrSend)
+    } else {
+        count(&dev.counters.Mirrored)
+    }
+}
+
+// answer pkt with a rate limited unreachable, sent back the way it came
+func (e *Engine) reject(dev *NetworkPort, pkt *Packet, reply *Packet, reason uint8) {
+    if !BuildUnreachable(pkt, reason, reply) || !e.icmp.Allow(time.Now()) {
+        count(&dev.counters.Dropped)
+        return
+    }
+
+    if e.sendError(dev, pkt, reply) {
+        count(&dev.counters.Rejected)
+    }
+}
+
+// drop pkt out of TTL, answering with a rate limited time exceeded
+func (e *Engine) expire(dev *NetworkPort, pkt *Packet, reply *Packet) {
+    count(&dev.counters.Expired)
+
+    if BuildTimeExceeded(pkt, e.address, reply) && e.icmp.Allow(time.Now()) {
+        e.sendError(dev, pkt, reply)
+    }
+}
+
+// send the ICMP error in reply back the way pkt came
+func (e *Engine) sendError(dev *NetworkPort, pkt *Packet, reply *Packet) bool {
+    egress := NETIO_LOCAL
+    if pkt.Peer != nil {
+        egress = NETIO_TUNNEL
+    }
+
+    reply.Target, reply.Route = pkt.Peer, e.route
+    if err := e.ports[egress].netio.Send(reply); err != nil {
+        count(&dev.counters.ErrSend)
+        return false
+    }
+
+    return true
+}
+
+/* Keep a kernel route to the TUN device for every subnet forwarded to the
+   tunnels. Peer endpoints move, so the routes are worked out again on every
+   tick and only applied when they change.
+*/
+func (e *Engine) syncRoutes() {
+    var last string
+
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    tun := e.ports[NETIO_LOCAL].netio.(*TunTap)
+
+    for {
+        if current := e.rules.rules.Load(); current != nil {
+            subnets, skipped := current.forwardedSubnets(e.peers.Endpoints())
+
+            if routes := fmt.Sprint(subnets, skipped); routes != last {
+                for _, subnet := range skipped {
+                    Print("Route to " + subnet.String() + " skipped, it contains a peer endpoint")
+                }
+
+                tun.SetRoutes(subnets)
+                last = routes
+            }
+        }
+
+        select {
+        case <-e.ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// age out policy entries installed with a TTL, and the peers they leave unused
+func (e *Engine) reapPolicies() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-e.ctx.Done():
+            return
+        case now := <-ticker.C:
+            for _, entry := range e.rules.Reap(now) {
+                Print("Policy entry expired: " + entry.String())
+            }
+
+            e.reapAnonymous()
+        }
+    }
+}
+
+/* Forget the peers only known by endpoint that no policy entry sends to and
+   that have no session left, so that entries coming and going through the
+   control API do not grow the peers without bound. Reload and the policy
+   mutex are held so that no entry picks one of them up meanwhile.
+*/
+func (e *Engine) reapAnonymous() {
+    e.reload.Lock()
+    defer e.reload.Unlock()
+
+    e.rules.Inspect(func(rules []*PolicyEntry) {
+        used := make(map[*Peer]bool)
+        for _, entry := range rules {
+            for _, peer := range entry.peers() {
+                used[peer] = true
+            }
+        }
+
+        for _, peer := range e.peers.List() {
+            if peer.anonymous && !used[peer] && peer.Idle() {
+                e.peers.remove(peer)
+                Print("Peer " + peer.String() + " removed, no policy entry uses it")
+            }
+        }
+    })
+}
+
+/* Probe the peers of load balanced and failover entries every interval
+   1 - send a probe to each of them, logging the peers that just failed
+   2 - move failover entries to their backup or back to their primary
+*/
+func (e *Engine) monitorPeers(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    tunnel := e.ports[NETIO_TUNNEL].netio.(*UDPSocket)
+    counters := &e.ports[NETIO_TUNNEL].counters
+
+    for {
+        select {
+        case <-e.ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        rules := e.rules.snapshot()
+
+        monitored := make(map[*Peer]bool)
+        for _, entry := range rules {
+            if entry.Action.group != nil {
+                for _, peer := range entry.Action.group.Peers() {
+                    monitored[peer] = true
+                }
+            }
+
+            if entry.Action.failover != nil {
+                monitored[entry.Action.failover.primary] = true
+                monitored[entry.Action.failover.backup] = true
+            }
+        }
+
+        for peer := range monitored {
+            failed, err := tunnel.SendProbe(peer)
+            if failed {
+                Print("Peer " + peer.String() + " is down, " + strconv.Itoa(tunnel.ProbeMisses) + " probes missed")
+            }
+
+            Log(err)
+        }
+
+        for _, entry := range rules {
+            if entry.Action.failover == nil {
+                continue
+            }
+
+            if active, switched := entry.Action.failover.Update(); switched {
+                if active == entry.Action.failover.backup {
+                    count(&counters.Failovers)
+                    Print("Failover to backup " + active.String() + ": " + entry.String())
+                } else {
+                    count(&counters.Failbacks)
+                    Print("Failback to primary " + active.String() + ": " + entry.String())
+                }
+            }
+        }
+    }
+}
+
+// stop the forwarding loops; Start cleans up once they have returned
+func (e *Engine) Shutdown() {
+    Print("Shutting down")
+    e.cancel()
+
+    // wake up the loops blocked in Receive
+    for _, port := range e.ports {
+        if interrupter, ok := port.netio.(Interrupter); ok {
+            Log(interrupter.Interrupt())
+        }
     }
 }
 
 func (e *Engine) PrintCounters() {
-    names := []string{"Local", "Tunnel", "Drop"}
     Print("Engine counters:")
 
-    for index, entry := range e.ports {
-        log.Println(names[index] + ":")
-        log.Println("\tReceived:\t", entry.counters.Received)
-        log.Println("\tSent:\t\t", entry.counters.Sent)
-        log.Println("\tDropped:\t", entry.counters.Dropped)
-        log.Println("\tUnsupported:\t", entry.counters.UnSupported)
-        log.Println("\tError Receive:\t", entry.counters.ErrReceive)
-        log.Println("\tError Send:\t", entry.counters.ErrSend)
+    for index := range e.ports {
+        counters := e.ports[index].counters.Snapshot()
+
+        log.Println(portNames[index] + ":")
+        log.Println("\tReceived:\t", counters.Received)
+        log.Println("\tSent:\t\t", counters.Sent)
+        log.Println("\tDropped:\t", counters.Dropped)
+        log.Println("\tUnsupported:\t", counters.UnSupported)
+        log.Println("\tError Receive:\t", counters.ErrReceive)
+        log.Println("\tError Send:\t", counters.ErrSend)
+        log.Println("\tError Auth:\t", counters.ErrAuth)
+        log.Println("\tReplayed:\t", counters.Replayed)
+        log.Println("\tDisallowed:\t", counters.Disallowed)
+        log.Println("\tRejected:\t", counters.Rejected)
+        log.Println("\tMirrored:\t", counters.Mirrored)
+        log.Println("\tFailovers:\t", counters.Failovers)
+        log.Println("\tFailbacks:\t", counters.Failbacks)
+        log.Println("\tNo transit:\t", counters.NoTransit)
+        log.Println("\tLooped:\t\t", counters.Looped)
+        log.Println("\tExpired:\t", counters.Expired)
+        log.Println("\tFragmented:\t", counters.Fragmented)
+        log.Println("\tToo big:\t", counters.TooBig)
+        log.Println("\tClamped:\t", counters.Clamped)
     }
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net"
+    "path/filepath"
+    "sync"
+    "testing"
+)
+
+func TestTransit(t *testing.T) {
+    e := &Engine{route: Route{Hops: 3, Path: 7}, loops: RateLimiter{Rate: LoopLogRate, Burst: 1}}
+    dev := &NetworkPort{}
+    relay := PolicyAction{transit: true}
+
+    // packets from the local port leave with the route of this node
+    pkt := Packet{}
+    if !e.transit(dev, &pkt, PolicyAction{}) || pkt.Route != e.route {
+        t.Fatalf("local packet route %v", pkt.Route)
+    }
+
+    // packets from the tunnels are only relayed by transit entries
+    pkt = Packet{Peer: &Peer{}, Route: Route{Hops: 3, Path: 1}}
+    if e.transit(dev, &pkt, PolicyAction{}) || dev.counters.NoTransit != 1 {
+        t.Fatalf("relayed without transit")
+    }
+
+    if !e.transit(dev, &pkt, relay) || pkt.Route != (Route{Hops: 2, Path: 1}) {
+        t.Fatalf("transit route %v", pkt.Route)
+    }
+
+    // out of hops, or back at the node it started from
+    for _, route := range []Route{{Hops: 1, Path: 1}, {Hops: 3, Path: 7}} {
+        pkt.Route = route
+        if e.transit(dev, &pkt, relay) {
+            t.Fatalf("route %v relayed", route)
+        }
+    }
+
+    if dev.counters.Looped != 2 {
+        t.Fatalf("looped %d", dev.counters.Looped)
+    }
+
+    header := appendDataHeader(nil, MessageData, Route{Hops: 5, Path: 0xbeef}, 1, 2)
+    if route := parseRoute(header); route != (Route{Hops: 5, Path: 0xbeef}) {
+        t.Fatalf("header route %v", route)
+    }
+}
+
+func TestPathID(t *testing.T) {
+    _, public, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    key, err := ParsePublicKey(public)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // every node works out the same ID for a key, never the one of keepalives
+    if id := pathID(key); id == 0 || id != pathID(key) {
+        t.Fatalf("path ID %d", id)
+    }
+}
+
+func TestExpireWithoutAddress(t *testing.T) {
+    e := &Engine{icmp: RateLimiter{Rate: ICMPRate, Burst: ICMPBurst}}
+    dev := &NetworkPort{}
+    reply := &Packet{Data: make([]byte, 2000)}
+
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, 0, 1, 0, 2, 0, 0, 0, 0)
+    pkt.Size = uint16(len(pkt.Data))
+    pkt.Data[9] = 17
+
+    // no port is set up, sending an error from the destination would panic
+    e.expire(dev, pkt, reply)
+
+    if dev.counters.Expired != 1 {
+        t.Fatalf("expired %d", dev.counters.Expired)
+    }
+}
+
+func TestEndpointEncoding(t *testing.T) {
+    for _, address := range []string{"192.0.2.1:9000", "[2001:db8::1]:51820"} {
+        endpoint, err := net.ResolveUDPAddr("udp", address)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        data := appendEndpoint(nil, endpoint)
+        if len(data) != EndpointSize || parseEndpoint(data).String() != address {
+            t.Errorf("%s: got %s", address, parseEndpoint(data))
+        }
+    }
+}
+
+func TestMirrorNeedsCapture(t *testing.T) {
+    capture := &Capture{}
+    e := &Engine{}
+    e.ports[NETIO_CAPTURE].netio = capture
+
+    mirror := PolicyEntryFile{DstSubnet: "10.0.0.0/8", Action: "MIRROR"}
+    if _, err := e.compileEntry(mirror); err != ErrPolicyNoCapture {
+        t.Fatalf("mirror without capture file: %v", err)
+    }
+
+    capture.Path = filepath.Join(t.TempDir(), "mirror.pcap")
+    if err := capture.Init(); err != nil {
+        t.Fatal(err)
+    }
+    defer capture.Close()
+
+    if _, err := e.compileEntry(mirror); err != nil {
+        t.Fatalf("mirror with capture file: %v", err)
+    }
+}
+
+func TestReapAnonymous(t *testing.T) {
+    key, public, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    e := &Engine{}
+    if err = e.peers.Init(key, public, nil); err != nil {
+        t.Fatal(err)
+    }
+    if err = e.rules.SetLookup(LookupFirstMatch); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, endpoint := range []string{"192.0.2.1:9000", "192.0.2.2:9000"} {
+        pol := PolicyEntryFile{Name: endpoint, Action: "FORWARD", Endpoint: endpoint}
+        err = e.rules.InsertCompiled(0, pol.Name, func() (*PolicyEntry, error) { return e.compileEntry(pol) })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    e.reapAnonymous()
+    if len(e.peers.List()) != 2 {
+        t.Fatalf("peers in use reaped: %d left", len(e.peers.List()))
+    }
+
+    if err = e.rules.DeleteByName("192.0.2.1:9000"); err != nil {
+        t.Fatal(err)
+    }
+
+    e.reapAnonymous()
+    peers := e.peers.List()
+    if len(peers) != 1 || peers[0].String() != "192.0.2.2:9000" {
+        t.Fatalf("peers left: %v", peers)
+    }
+}
+
+// port replaying packets, then stopping the engine
+type testPort struct {
+    packets []Packet
+    sent    []Packet
+    stop    context.CancelFunc
+}
+
+func (p *testPort) Init() (error)   { return nil }
+func (p *testPort) Close() (error)  { return nil }
+
+func (p *testPort) Receive(pkt *Packet) (error) {
+    if len(p.packets) == 0 {
+        p.stop()
+        return io.EOF
+    }
+
+    pkt.Size = uint16(copy(pkt.Data, p.packets[0].Data[:p.packets[0].Size]))
+    pkt.Peer = p.packets[0].Peer
+    p.packets = p.packets[1:]
+
+    return nil
+}
+
+func (p *testPort) Send(pkt *Packet) (error) {
+    p.sent = append(p.sent, Packet{Data: append([]byte{}, pkt.Data[:pkt.Size]...), Size: pkt.Size, Peer: pkt.Peer})
+    return nil
+}
+
+func TestForwardDisallowed(t *testing.T) {
+    peers, _ := testPeers(t)
+    peer := peers.ByName("b")
+
+    e := &Engine{}
+    e.ctx, e.cancel = context.WithCancel(context.Background())
+    if err := e.rules.SetLookup(LookupFirstMatch); err != nil {
+        t.Fatal(err)
+    }
+
+    local, err := e.compileEntry(PolicyEntryFile{Action: "LOCAL"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    e.rules.Replace([]*PolicyEntry{local})
+
+    allowed, disallowed := testPacket("10.2.0.1", "10.0.0.1"), testPacket("10.1.0.1", "10.0.0.1")
+    allowed.Peer, disallowed.Peer = peer, peer
+
+    // the IPv6 source is outside the IPv4 subnets allowed too
+    tunnel := &testPort{packets: []Packet{*disallowed, *allowed, *testPacket6("fd00::1", "fd00::2", 17)}, stop: e.cancel}
+    tunnel.packets[2].Peer = peer
+    device := &testPort{}
+    e.ports[NETIO_TUNNEL].netio, e.ports[NETIO_LOCAL].netio = tunnel, device
+
+    var waitGroup sync.WaitGroup
+    waitGroup.Add(1)
+    e.Forward(&e.ports[NETIO_TUNNEL], &waitGroup)
+
+    counters := e.ports[NETIO_TUNNEL].counters.Snapshot()
+    if counters.Disallowed != 2 || counters.Sent != 1 {
+        t.Fatalf("disallowed %d, sent %d", counters.Disallowed, counters.Sent)
+    }
+
+    if len(device.sent) != 1 || !device.sent[0].GetSource().Equal(net.ParseIP("10.2.0.1")) {
+        t.Fatalf("forwarded %d packets", len(device.sent))
+    }
+}
@@ -0,0 +1,302 @@
+// Noise IK style handshake establishing tunnel sessions
+package main
+
+import (
+    "bytes"
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "time"
+)
+
+const (
+    handshakeConstruction = "Noise_IK_25519_AESGCM_SHA256"
+    handshakeIdentifier   = "wirelay v1"
+)
+
+var (
+    ErrHandshakeInvalid   = errors.New("Invalid handshake message")
+    ErrHandshakeReplay    = errors.New("Replayed handshake initiation")
+    ErrHandshakeUnknown   = errors.New("Handshake from unknown peer")
+)
+
+// state of a handshake in progress, for either side
+type Handshake struct {
+    hash            [32]byte
+    chain           [32]byte
+    ephemeral       *ecdh.PrivateKey
+    remoteEphemeral *ecdh.PublicKey
+    remoteStatic    *ecdh.PublicKey
+    local           uint32
+    remote          uint32
+    started         time.Time
+}
+
+func (hs *Handshake) mixHash(data []byte) {
+    hs.hash = sha256.Sum256(append(hs.hash[:], data...))
+}
+
+// advance the chaining key with input and return a message key
+func (hs *Handshake) mixKey(input []byte) ([]byte, error) {
+    var keys [][]byte
+    var err error
+
+    if keys, err = kdf(hs.chain[:], input, 2); err != nil {
+        return nil, err
+    }
+
+    copy(hs.chain[:], keys[0])
+    return keys[1], nil
+}
+
+// mix the result of a Diffie-Hellman operation into the chaining key
+func (hs *Handshake) mixDH(key *ecdh.PrivateKey, remote *ecdh.PublicKey) ([]byte, error) {
+    var secret []byte
+    var err error
+
+    if secret, err = key.ECDH(remote); err != nil {
+        return nil, err
+    }
+
+    return hs.mixKey(secret)
+}
+
+// seal plaintext with the handshake hash as associated data, then absorb the ciphertext
+func (hs *Handshake) seal(dst []byte, key []byte, plaintext []byte) ([]byte, error) {
+    var nonce [NonceSize]byte
+
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+
+    start := len(dst)
+    dst = aead.Seal(dst, nonce[:], plaintext, hs.hash[:])
+    hs.mixHash(dst[start:])
+
+    return dst, nil
+}
+
+func (hs *Handshake) open(key []byte, ciphertext []byte) ([]byte, error) {
+    var nonce [NonceSize]byte
+
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+
+    plaintext, err := aead.Open(nil, nonce[:], ciphertext, hs.hash[:])
+    if err != nil {
+        return nil, ErrHandshakeInvalid
+    }
+
+    hs.mixHash(ciphertext)
+    return plaintext, nil
+}
+
+// both sides start from the construction name and the responder static key
+func (hs *Handshake) init(responder *ecdh.PublicKey) {
+    hs.chain = sha256.Sum256([]byte(handshakeConstruction))
+    hs.hash = hs.chain
+    hs.mixHash([]byte(handshakeIdentifier))
+    hs.mixHash(responder.Bytes())
+}
+
+// 12 byte timestamp, increasing between initiations of the same peer
+func handshakeTimestamp() []byte {
+    var ts [TimestampSize]byte
+
+    now := time.Now()
+    binary.BigEndian.PutUint64(ts[0:8], uint64(now.Unix()))
+    binary.BigEndian.PutUint32(ts[8:12], uint32(now.Nanosecond()))
+
+    return ts[:]
+}
+
+/* Create the initiation message towards a responder
+   1 - e, es: ephemeral key mixed with the responder static key
+   2 - s, ss: our static key encrypted, then mixed with the responder static key
+   3 - the timestamp is encrypted to prevent replaying the initiation
+*/
+func (hs *Handshake) CreateInitiation(static *ecdh.PrivateKey, remote *ecdh.PublicKey, local uint32) ([]byte, error) {
+    var key []byte
+    var err error
+
+    *hs = Handshake{remoteStatic: remote, local: local, started: time.Now()}
+    hs.init(remote)
+
+    if hs.ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+        return nil, err
+    }
+
+    msg := make([]byte, 8, MessageInitiationSize)
+    msg[0] = MessageInitiation
+    binary.BigEndian.PutUint32(msg[4:8], local)
+
+    ephemeral := hs.ephemeral.PublicKey().Bytes()
+    msg = append(msg, ephemeral...)
+    hs.mixHash(ephemeral)
+    if _, err = hs.mixKey(ephemeral); err != nil {
+        return nil, err
+    }
+
+    if key, err = hs.mixDH(hs.ephemeral, remote); err != nil {
+        return nil, err
+    }
+
+    if msg, err = hs.seal(msg, key, static.PublicKey().Bytes()); err != nil {
+        return nil, err
+    }
+
+    if key, err = hs.mixDH(static, remote); err != nil {
+        return nil, err
+    }
+
+    return hs.seal(msg, key, handshakeTimestamp())
+}
+
+// consume an initiation as responder, returning the initiator timestamp
+func (hs *Handshake) ConsumeInitiation(static *ecdh.PrivateKey, msg []byte) ([]byte, error) {
+    var key, plaintext []byte
+    var err error
+
+    if len(msg) != MessageInitiationSize || msg[0] != MessageInitiation {
+        return nil, ErrHandshakeInvalid
+    }
+
+    *hs = Handshake{remote: binary.BigEndian.Uint32(msg[4:8]), started: time.Now()}
+    hs.init(static.PublicKey())
+
+    if hs.remoteEphemeral, err = ecdh.X25519().NewPublicKey(msg[8:40]); err != nil {
+        return nil, ErrHandshakeInvalid
+    }
+
+    hs.mixHash(msg[8:40])
+    if _, err = hs.mixKey(msg[8:40]); err != nil {
+        return nil, err
+    }
+
+    if key, err = hs.mixDH(static, hs.remoteEphemeral); err != nil {
+        return nil, ErrHandshakeInvalid
+    }
+
+    if plaintext, err = hs.open(key, msg[40:88]); err != nil {
+        return nil, err
+    }
+
+    if hs.remoteStatic, err = ecdh.X25519().NewPublicKey(plaintext); err != nil {
+        return nil, ErrHandshakeInvalid
+    }
+
+    if key, err = hs.mixDH(static, hs.remoteStatic); err != nil {
+        return nil, ErrHandshakeInvalid
+    }
+
+    return hs.open(key, msg[88:116])
+}
+
+/* Create the response to a consumed initiation
+   e, ee, se: our ephemeral key mixed with both initiator keys, then an empty
+   payload proves we derived the same chaining key
+*/
+func (hs *Handshake) CreateResponse(local uint32) ([]byte, error) {
+    var key []byte
+    var err error
+
+    hs.local = local
+    if hs.ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+        return nil, err
+    }
+
+    msg := make([]byte, 12, MessageResponseSize)
+    msg[0] = MessageResponse
+    binary.BigEndian.PutUint32(msg[4:8], local)
+    binary.BigEndian.PutUint32(msg[8:12], hs.remote)
+
+    ephemeral := hs.ephemeral.PublicKey().Bytes()
+    msg = append(msg, ephemeral...)
+    hs.mixHash(ephemeral)
+    if _, err = hs.mixKey(ephemeral); err != nil {
+        return nil, err
+    }
+
+    if _, err = hs.mixDH(hs.ephemeral, hs.remoteEphemeral); err != nil {
+        return nil, err
+    }
+
+    if _, err = hs.mixDH(hs.ephemeral, hs.remoteStatic); err != nil {
+        return nil, err
+    }
+
+    if key, err = hs.mixKey(nil); err != nil {
+        return nil, err
+    }
+
+    return hs.seal(msg, key, nil)
+}
+
+// consume a response as initiator
+func (hs *Handshake) ConsumeResponse(static *ecdh.PrivateKey, msg []byte) (error) {
+    var key []byte
+    var err error
+
+    if len(msg) != MessageResponseSize || msg[0] != MessageResponse {
+        return ErrHandshakeInvalid
+    }
+
+    if hs.ephemeral == nil || binary.BigEndian.Uint32(msg[8:12]) != hs.local {
+        return ErrHandshakeInvalid
+    }
+
+    if hs.remoteEphemeral, err = ecdh.X25519().NewPublicKey(msg[12:44]); err != nil {
+        return ErrHandshakeInvalid
+    }
+
+    hs.mixHash(msg[12:44])
+    if _, err = hs.mixKey(msg[12:44]); err != nil {
+        return err
+    }
+
+    if _, err = hs.mixDH(hs.ephemeral, hs.remoteEphemeral); err != nil {
+        return ErrHandshakeInvalid
+    }
+
+    if _, err = hs.mixDH(static, hs.remoteEphemeral); err != nil {
+        return ErrHandshakeInvalid
+    }
+
+    if key, err = hs.mixKey(nil); err != nil {
+        return err
+    }
+
+    if _, err = hs.open(key, msg[44:60]); err != nil {
+        return err
+    }
+
+    hs.remote = binary.BigEndian.Uint32(msg[4:8])
+    return nil
+}
+
+// derive the transport session once the handshake is complete
+func (hs *Handshake) Session(peer *Peer, initiator bool) (*Session, error) {
+    var keys [][]byte
+    var err error
+
+    if keys, err = kdf(hs.chain[:], nil, 2); err != nil {
+        return nil, err
+    }
+
+    send, recv := keys[0], keys[1]
+    if !initiator {
+        send, recv = recv, send
+    }
+
+    return NewSession(peer, hs.local, hs.remote, send, recv, initiator)
+}
+
+// initiation timestamps must strictly increase per peer
+func newerTimestamp(ts []byte, last []byte) bool {
+    return bytes.Compare(ts, last) > 0
+}
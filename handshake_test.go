@@ -0,0 +1,138 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+// two peer sets knowing each other, named after the other side
+func testPeers(t *testing.T) (*Peers, *Peers) {
+    keyA, pubA, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    keyB, pubB, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    a, b := &Peers{}, &Peers{}
+    if err = a.Init(keyA, "", []PeerEntryFile{{Name: "b", Pubkey: pubB, Endpoint: "127.0.0.1:2", Allowed: []string{"10.2.0.0/16"}}}); err != nil {
+        t.Fatal(err)
+    }
+
+    if err = b.Init(keyB, "", []PeerEntryFile{{Name: "a", Pubkey: pubA, Endpoint: "127.0.0.1:1", Allowed: []string{"10.1.0.0/16"}}}); err != nil {
+        t.Fatal(err)
+    }
+
+    return a, b
+}
+
+func TestHandshakeSession(t *testing.T) {
+    a, b := testPeers(t)
+    endpoint := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+    initiation, err := a.Initiate(a.ByName("b"), time.Now())
+    if err != nil || len(initiation) != MessageInitiationSize {
+        t.Fatalf("initiation: %v", err)
+    }
+
+    // a tampered initiation fails, the genuine one is only accepted once
+    tampered := append([]byte{}, initiation...)
+    tampered[60] ^= 1
+    if _, _, err = b.ConsumeInitiation(tampered, endpoint); err == nil {
+        t.Fatal("tampered initiation accepted")
+    }
+
+    _, response, err := b.ConsumeInitiation(initiation, endpoint)
+    if err != nil {
+        t.Fatalf("initiation: %v", err)
+    }
+
+    if _, _, err = b.ConsumeInitiation(initiation, endpoint); err == nil {
+        t.Fatal("replayed initiation accepted")
+    }
+
+    tampered = append([]byte{}, response...)
+    tampered[50] ^= 1
+    if _, _, err = a.ConsumeResponse(tampered); err == nil {
+        t.Fatal("tampered response accepted")
+    }
+
+    _, sender, err := a.ConsumeResponse(response)
+    if err != nil {
+        t.Fatalf("response: %v", err)
+    }
+
+    // data from the initiator opens on the responder session and confirms it
+    msg, err := sender.Seal(nil, Route{Hops: 3, Path: 9}, []byte("hello"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    receiver := b.Session(msg)
+    if receiver == nil {
+        t.Fatal("no session for the data message")
+    }
+
+    payload, err := receiver.Open(nil, msg)
+    if err != nil || string(payload) != "hello" {
+        t.Fatalf("open: %q, %v", payload, err)
+    }
+
+    if _, err = receiver.Open(nil, msg); err != ErrTunnelReplay {
+        t.Fatalf("replayed data: %v", err)
+    }
+
+    // header and payload are both authenticated
+    for _, index := range []int{1, MessageDataHeaderSize} {
+        msg, _ = sender.Seal(nil, Route{}, []byte("hello"))
+        msg[index] ^= 1
+
+        if _, err = receiver.Open(nil, msg); err != ErrTunnelAuth {
+            t.Errorf("tampered byte %d: %v", index, err)
+        }
+    }
+
+    // and the other way once confirmed
+    b.Confirm(receiver)
+    if msg, err = b.ByName("a").Session().Seal(nil, Route{}, []byte("back")); err != nil {
+        t.Fatal(err)
+    }
+
+    if payload, err = a.Session(msg).Open(nil, msg); err != nil || string(payload) != "back" {
+        t.Fatalf("open reply: %q, %v", payload, err)
+    }
+}
+
+func TestKeepaliveRekey(t *testing.T) {
+    a, b := testPeers(t)
+    peer := a.ByName("b")
+    peer.keepalive = time.Second
+
+    initiation, err := a.Initiate(peer, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, response, err := b.ConsumeInitiation(initiation, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, session, err := a.ConsumeResponse(response)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // a session only kept open by keepalives is rekeyed before it is rejected
+    now := time.Now().Add(RekeyAfterTime + time.Second)
+    session.lastUsed.Store(now.UnixNano())
+
+    retransmit, keepalives := a.Maintain(now)
+    if len(keepalives) != 1 || len(retransmit[peer]) != MessageInitiationSize {
+        t.Fatalf("keepalives %d, initiation %d bytes", len(keepalives), len(retransmit[peer]))
+    }
+}
@@ -0,0 +1,286 @@
+// ICMP errors generated by the engine
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "net"
+    "sync"
+    "time"
+    "water/waterutil"
+)
+
+const (
+    ICMPv4Unreachable   = 3
+    ICMPv6Unreachable   = 1
+    ICMPv4TimeExceeded  = 11
+    ICMPv6TimeExceeded  = 3
+    ICMPv6TooBig        = 2
+    ICMPv4FragNeeded    = 4     // code of destination unreachable
+    ICMPHeaderSize      = 8
+    ICMPv4MaxSize       = 576   // RFC 1812 4.3.2.3
+    ICMPv6MaxSize       = 1280  // RFC 4443 2.4 (c)
+    ICMPHopLimit        = 64
+    ICMPRate            = 10    // errors per second
+    ICMPBurst           = 20
+)
+
+// reasons given in an unreachable, RejectNone for actions that do not reject
+const (
+    RejectNone uint8 = iota
+    RejectNetwork
+    RejectHost
+    RejectAdmin
+)
+
+var ErrRejectReason = errors.New("Unknown reject reason")
+
+var rejectNames = map[string]uint8{
+    "net"   : RejectNetwork,
+    "host"  : RejectHost,
+    "admin" : RejectAdmin,
+}
+
+// codes of destination unreachable per reason, for IPv4 and IPv6
+var rejectCodes = map[uint8][2]uint8{
+    RejectNetwork   : {0, 0},   // network unreachable, no route
+    RejectHost      : {1, 3},   // host unreachable, address unreachable
+    RejectAdmin     : {13, 1},  // communication administratively prohibited
+}
+
+// reason of a REJECT action, administratively prohibited by default
+func parseRejectReason(name string) (uint8, error) {
+    if name == "" {
+        return RejectAdmin, nil
+    }
+
+    if reason, found := rejectNames[name]; found {
+        return reason, nil
+    }
+
+    return RejectNone, ErrRejectReason
+}
+
+func rejectName(reason uint8) string {
+    for name, value := range rejectNames {
+        if value == reason {
+            return name
+        }
+    }
+
+    return "unknown"
+}
+
+/* Build a destination unreachable for pkt into reply, addressed back to its
+   source from its destination and quoting as much of it as fits.
+   No error is sent for ICMP errors, IPv4 fragments other than the first, or
+   packets from or to addresses that are not unicast.
+*/
+func BuildUnreachable(pkt *Packet, reason uint8, reply *Packet) bool {
+    if pkt.IsIPv6() {
+        return buildErrorIPv6(pkt, ICMPv6Unreachable, rejectCodes[reason][1], 0, nil, reply)
+    }
+
+    return buildErrorIPv4(pkt, ICMPv4Unreachable, rejectCodes[reason][0], 0, nil, reply)
+}
+
+/* Time exceeded in transit for pkt, from source. The error comes from this
+   hop, so none is built when source is not of the version of pkt: sending
+   it from the destination would show that host in place of the hop.
+*/
+func BuildTimeExceeded(pkt *Packet, source net.IP, reply *Packet) bool {
+    if pkt.IsIPv6() {
+        if source = sourceIPv6(source); source == nil {
+            return false
+        }
+
+        return buildErrorIPv6(pkt, ICMPv6TimeExceeded, 0, 0, source, reply)
+    }
+
+    if source = source.To4(); source == nil {
+        return false
+    }
+
+    return buildErrorIPv4(pkt, ICMPv4TimeExceeded, 0, 0, source, reply)
+}
+
+// fragmentation needed or packet too big for pkt, giving the MTU it must fit in
+func BuildTooBig(pkt *Packet, mtu int, source net.IP, reply *Packet) bool {
+    if pkt.IsIPv6() {
+        return buildErrorIPv6(pkt, ICMPv6TooBig, 0, uint32(mtu), sourceIPv6(source), reply)
+    }
+
+    return buildErrorIPv4(pkt, ICMPv4Unreachable, ICMPv4FragNeeded, uint32(mtu), source.To4(), reply)
+}
+
+func sourceIPv6(source net.IP) net.IP {
+    if source.To4() != nil {
+        return nil
+    }
+
+    return source
+}
+
+/* ICMP error of kind and code for pkt, with rest as the second word of the
+   ICMP header, sent from source or, if nil, from the destination of pkt
+*/
+func buildErrorIPv4(pkt *Packet, kind uint8, code uint8, rest uint32, source net.IP, reply *Packet) bool {
+    src, dst := pkt.GetSourceIPv4(), pkt.GetDestinationIPv4()
+    if !unicast(src) || !unicast(dst) || src.Equal(net.IPv4bcast) {
+        return false
+    }
+
+    payload := pkt.Payload()
+    if payload == nil {
+        return false
+    }
+
+    if pkt.Protocol() == waterutil.ICMP && (len(payload) == 0 || icmpv4Error(payload[0])) {
+        return false
+    }
+
+    quote := pkt.Data[:min(int(pkt.Size), ICMPv4MaxSize - IPv4HeaderSize - ICMPHeaderSize)]
+    size := IPv4HeaderSize + ICMPHeaderSize + len(quote)
+
+    header := reply.Data[:IPv4HeaderSize]
+    clear(header)
+    header[0] = 0x45
+    binary.BigEndian.PutUint16(header[2:4], uint16(size))
+    header[8] = ICMPHopLimit
+    header[9] = waterutil.ICMP
+    copy(header[12:16], dst.To4())
+    if source != nil {
+        copy(header[12:16], source)
+    }
+    copy(header[16:20], src.To4())
+    binary.BigEndian.PutUint16(header[10:12], Checksum(0, header))
+
+    message := reply.Data[IPv4HeaderSize:size]
+    clear(message[:ICMPHeaderSize])
+    message[0] = kind
+    message[1] = code
+    binary.BigEndian.PutUint32(message[4:8], rest)
+    copy(message[ICMPHeaderSize:], quote)
+    binary.BigEndian.PutUint16(message[2:4], Checksum(0, message))
+
+    reply.Size = uint16(size)
+    return true
+}
+
+func buildErrorIPv6(pkt *Packet, kind uint8, code uint8, rest uint32, source net.IP, reply *Packet) bool {
+    src, dst := pkt.GetSourceIPv6(), pkt.GetDestinationIPv6()
+    if !unicast(src) || !unicast(dst) {
+        return false
+    }
+
+    // ICMPv6 types below 128 are errors
+    if payload := pkt.Payload(); pkt.Protocol() == waterutil.IPv6_ICMP && (len(payload) == 0 || payload[0] < 128) {
+        return false
+    }
+
+    quote := pkt.Data[:min(int(pkt.Size), ICMPv6MaxSize - IPv6HeaderSize - ICMPHeaderSize)]
+    size := IPv6HeaderSize + ICMPHeaderSize + len(quote)
+
+    header := reply.Data[:IPv6HeaderSize]
+    clear(header)
+    header[0] = 0x60
+    binary.BigEndian.PutUint16(header[4:6], uint16(size - IPv6HeaderSize))
+    header[6] = waterutil.IPv6_ICMP
+    header[7] = ICMPHopLimit
+    copy(header[8:24], dst)
+    if source != nil {
+        copy(header[8:24], source.To16())
+    }
+    copy(header[24:40], src)
+
+    message := reply.Data[IPv6HeaderSize:size]
+    clear(message[:ICMPHeaderSize])
+    message[0] = kind
+    message[1] = code
+    binary.BigEndian.PutUint32(message[4:8], rest)
+    copy(message[ICMPHeaderSize:], quote)
+    binary.BigEndian.PutUint16(message[2:4], Checksum(PseudoHeaderSum(header, waterutil.IPv6_ICMP, len(message)), message))
+
+    reply.Size = uint16(size)
+    return true
+}
+
+func icmpv4Error(kind uint8) bool {
+    switch kind {
+    case 3, 4, 5, 11, 12:
+        return true
+    }
+
+    return false
+}
+
+func unicast(ip net.IP) bool {
+    return !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// one's complement sum of data added to sum, folded and complemented
+func Checksum(sum uint32, data []byte) uint16 {
+    for len(data) >= 2 {
+        sum += uint32(binary.BigEndian.Uint16(data))
+        data = data[2:]
+    }
+
+    if len(data) == 1 {
+        sum += uint32(data[0]) << 8
+    }
+
+    for sum > 0xffff {
+        sum = (sum >> 16) + (sum & 0xffff)
+    }
+
+    return ^uint16(sum)
+}
+
+// checksum after a 16 bit word covered by it changed from old to new, RFC 1624
+func UpdateChecksum(checksum uint16, old uint16, new uint16) uint16 {
+    sum := uint32(^checksum) + uint32(^old) + uint32(new)
+    for sum > 0xffff {
+        sum = (sum >> 16) + (sum & 0xffff)
+    }
+
+    return ^uint16(sum)
+}
+
+// sum of the IPv6 pseudo header of an upper layer message
+func PseudoHeaderSum(header []byte, protocol uint8, length int) uint32 {
+    var sum uint32
+
+    for index := 8; index < 40; index += 2 {
+        sum += uint32(binary.BigEndian.Uint16(header[index:]))
+    }
+
+    return sum + uint32(length) + uint32(protocol)
+}
+
+// token bucket limiting the ICMP errors sent by the engine
+type RateLimiter struct {
+    mutex   sync.Mutex
+    tokens  float64
+    last    time.Time
+    Rate    float64
+    Burst   float64
+}
+
+func (r *RateLimiter) Allow(now time.Time) bool {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if r.last.IsZero() {
+        r.tokens = r.Burst
+    } else {
+        r.tokens = min(r.Burst, r.tokens + now.Sub(r.last).Seconds() * r.Rate)
+    }
+    r.last = now
+
+    if r.tokens < 1 {
+        return false
+    }
+
+    r.tokens--
+    return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestBuildUnreachable(t *testing.T) {
+    reply := &Packet{Data: make([]byte, 2000)}
+
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, 0, 1, 0, 2, 0, 0, 0, 0)
+    pkt.Size = uint16(len(pkt.Data))
+    pkt.Data[9] = 17
+
+    if !BuildUnreachable(pkt, RejectAdmin, reply) {
+        t.Fatal("no unreachable for a UDP packet")
+    }
+
+    if int(reply.Size) != IPv4HeaderSize + ICMPHeaderSize + int(pkt.Size) {
+        t.Errorf("size %d", reply.Size)
+    }
+
+    if Checksum(0, reply.Data[:IPv4HeaderSize]) != 0 || Checksum(0, reply.Data[IPv4HeaderSize:reply.Size]) != 0 {
+        t.Error("bad IPv4 or ICMP checksum")
+    }
+
+    if !reply.GetSource().Equal(net.ParseIP("10.0.0.2")) || reply.Data[20] != ICMPv4Unreachable || reply.Data[21] != 13 {
+        t.Errorf("unexpected reply % x", reply.Data[:28])
+    }
+
+    // never answer an ICMP error with another one
+    quoted := &Packet{Data: append([]byte{}, reply.Data[:reply.Size]...), Size: reply.Size}
+    if BuildUnreachable(quoted, RejectAdmin, reply) {
+        t.Error("unreachable sent for an ICMP error")
+    }
+
+    pkt6 := &Packet{Data: make([]byte, IPv6HeaderSize + 8), Size: IPv6HeaderSize + 8}
+    pkt6.Data[0] = 0x60
+    pkt6.Data[6] = 17
+    copy(pkt6.Data[8:24], net.ParseIP("fd00::1"))
+    copy(pkt6.Data[24:40], net.ParseIP("fd00::2"))
+
+    if !BuildUnreachable(pkt6, RejectHost, reply) {
+        t.Fatal("no unreachable for an IPv6 UDP packet")
+    }
+
+    message := reply.Data[IPv6HeaderSize:reply.Size]
+    if Checksum(PseudoHeaderSum(reply.Data, 58, len(message)), message) != 0 || message[1] != 3 {
+        t.Errorf("unexpected ICMPv6 reply % x", message[:8])
+    }
+}
+
+func TestTimeExceeded(t *testing.T) {
+    reply := &Packet{Data: make([]byte, 2000)}
+
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, 0, 1, 0, 2, 0, 0, 0, 0)
+    pkt.Size = uint16(len(pkt.Data))
+    pkt.Data[8], pkt.Data[9] = 2, 17
+    binary.BigEndian.PutUint16(pkt.Data[10:12], Checksum(0, pkt.Data[:IPv4HeaderSize]))
+
+    // the incremental update matches a full checksum of the header
+    if !pkt.DecrementTTL() || pkt.Data[8] != 1 || Checksum(0, pkt.Data[:IPv4HeaderSize]) != 0 {
+        t.Fatalf("bad decrement % x", pkt.Data[:IPv4HeaderSize])
+    }
+
+    if pkt.DecrementTTL() || pkt.Data[8] != 1 {
+        t.Fatal("packet forwarded with no hop left")
+    }
+
+    if !BuildTimeExceeded(pkt, net.ParseIP("10.9.9.9"), reply) {
+        t.Fatal("no time exceeded for a UDP packet")
+    }
+
+    if !reply.GetSource().Equal(net.ParseIP("10.9.9.9")) || reply.Data[20] != ICMPv4TimeExceeded || reply.Data[21] != 0 {
+        t.Errorf("unexpected reply % x", reply.Data[:28])
+    }
+
+    if Checksum(0, reply.Data[:IPv4HeaderSize]) != 0 || Checksum(0, reply.Data[IPv4HeaderSize:reply.Size]) != 0 {
+        t.Error("bad IPv4 or ICMP checksum")
+    }
+
+    // without an address of the version of the packet nothing is sent
+    for _, source := range []net.IP{nil, net.ParseIP("fd00::9")} {
+        if BuildTimeExceeded(pkt, source, reply) {
+            t.Errorf("time exceeded sent from %s as %s", source, reply.GetSource())
+        }
+    }
+}
+
+func TestRateLimiter(t *testing.T) {
+    limiter := RateLimiter{Rate: 10, Burst: 2}
+    now := time.Now()
+
+    if !limiter.Allow(now) || !limiter.Allow(now) || limiter.Allow(now) {
+        t.Error("burst not enforced")
+    }
+
+    if !limiter.Allow(now.Add(100 * time.Millisecond)) {
+        t.Error("token not refilled")
+    }
+}
@@ -2,11 +2,16 @@ package main
 
 import (
     "fmt"
+    "os"
 )
 
 func main() {
     var engine Engine
 
+    if len(os.Args) > 1 && os.Args[1] == "ctl" {
+        os.Exit(Ctl(os.Args[2:]))
+    }
+
     if err := engine.Init(); err != nil {
         fmt.Println(err)
         return
@@ -0,0 +1,228 @@
+// transport level policy match criteria
+package main
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+    "water/waterutil"
+)
+
+var (
+    ErrMatchProtocol  = errors.New("Unknown protocol")
+    ErrMatchPortRange = errors.New("Invalid port range")
+    ErrMatchDSCP      = errors.New("DSCP must be between 0 and 63")
+    ErrMatchICMP      = errors.New("ICMP type and code must be between 0 and 255")
+    ErrMatchPorts     = errors.New("Ports need protocol tcp or udp")
+)
+
+var protocolNames = map[string]uint8{
+    "icmp"      : waterutil.ICMP,
+    "tcp"       : waterutil.TCP,
+    "udp"       : waterutil.UDP,
+    "gre"       : waterutil.GRE,
+    "esp"       : waterutil.ESP,
+    "icmpv6"    : waterutil.IPv6_ICMP,
+}
+
+type PortRange struct {
+    low     uint16
+    high    uint16
+}
+
+// criteria beyond the addresses; any unset criterion matches every packet
+type TransportMatch struct {
+    protocol    int     // -1 for any
+    srcPorts    *PortRange
+    dstPorts    *PortRange
+    dscp        int     // -1 for any
+    icmpType    int     // -1 for any
+    icmpCode    int     // -1 for any
+}
+
+// protocol by name or number
+func parseProtocol(value string) (int, error) {
+    if number, found := protocolNames[strings.ToLower(value)]; found {
+        return int(number), nil
+    }
+
+    number, err := strconv.Atoi(value)
+    if err != nil || number < 0 || number > 255 {
+        return 0, ErrMatchProtocol
+    }
+
+    return number, nil
+}
+
+// single port "22" or inclusive range "1024-2047"
+func parsePortRange(value string) (*PortRange, error) {
+    low, high, isRange := strings.Cut(value, "-")
+    if !isRange {
+        high = low
+    }
+
+    first, err := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+    if err != nil {
+        return nil, ErrMatchPortRange
+    }
+
+    last, err := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+    if err != nil || last < first {
+        return nil, ErrMatchPortRange
+    }
+
+    return &PortRange{low: uint16(first), high: uint16(last)}, nil
+}
+
+func (r *PortRange) Contains(port uint16) bool {
+    return port >= r.low && port <= r.high
+}
+
+func (r *PortRange) String() string {
+    if r.low == r.high {
+        return strconv.Itoa(int(r.low))
+    }
+
+    return strconv.Itoa(int(r.low)) + "-" + strconv.Itoa(int(r.high))
+}
+
+func CompileTransportMatch(pol PolicyEntryFile) (TransportMatch, error) {
+    var err error
+
+    m := TransportMatch{protocol: -1, dscp: -1, icmpType: -1, icmpCode: -1}
+
+    if pol.Protocol != "" {
+        if m.protocol, err = parseProtocol(pol.Protocol); err != nil {
+            return m, err
+        }
+    }
+
+    if pol.SrcPort != "" || pol.DstPort != "" {
+        if m.protocol != waterutil.TCP && m.protocol != waterutil.UDP {
+            return m, ErrMatchPorts
+        }
+    }
+
+    if pol.SrcPort != "" {
+        if m.srcPorts, err = parsePortRange(pol.SrcPort); err != nil {
+            return m, err
+        }
+    }
+
+    if pol.DstPort != "" {
+        if m.dstPorts, err = parsePortRange(pol.DstPort); err != nil {
+            return m, err
+        }
+    }
+
+    if pol.DSCP != nil {
+        if *pol.DSCP < 0 || *pol.DSCP > 63 {
+            return m, ErrMatchDSCP
+        }
+        m.dscp = *pol.DSCP
+    }
+
+    // ICMP type and code imply ICMP, for IPv4 or IPv6
+    if pol.ICMPType != nil {
+        if *pol.ICMPType < 0 || *pol.ICMPType > 255 {
+            return m, ErrMatchICMP
+        }
+        m.icmpType = *pol.ICMPType
+    }
+
+    if pol.ICMPCode != nil {
+        if *pol.ICMPCode < 0 || *pol.ICMPCode > 255 {
+            return m, ErrMatchICMP
+        }
+        m.icmpCode = *pol.ICMPCode
+    }
+
+    return m, nil
+}
+
+func (m *TransportMatch) Any() bool {
+    return m.protocol < 0 && m.dscp < 0 && m.icmpType < 0 && m.icmpCode < 0
+}
+
+func (m *TransportMatch) Matches(pkt *Packet) bool {
+    if m.Any() {
+        return true
+    }
+
+    protocol := int(pkt.Protocol())
+    if m.protocol >= 0 && protocol != m.protocol {
+        return false
+    }
+
+    if m.dscp >= 0 && int(pkt.DSCP()) != m.dscp {
+        return false
+    }
+
+    if m.srcPorts != nil || m.dstPorts != nil {
+        sport, dport, valid := pkt.Ports()
+        if !valid {
+            return false
+        }
+
+        if m.srcPorts != nil && !m.srcPorts.Contains(sport) {
+            return false
+        }
+
+        if m.dstPorts != nil && !m.dstPorts.Contains(dport) {
+            return false
+        }
+    }
+
+    if m.icmpType >= 0 || m.icmpCode >= 0 {
+        payload := pkt.Payload()
+        if (protocol != waterutil.ICMP && protocol != waterutil.IPv6_ICMP) || len(payload) < 2 {
+            return false
+        }
+
+        if m.icmpType >= 0 && int(payload[0]) != m.icmpType {
+            return false
+        }
+
+        if m.icmpCode >= 0 && int(payload[1]) != m.icmpCode {
+            return false
+        }
+    }
+
+    return true
+}
+
+func (m *TransportMatch) String() string {
+    var parts []string
+
+    if m.protocol >= 0 {
+        name := strconv.Itoa(m.protocol)
+        for key, number := range protocolNames {
+            if int(number) == m.protocol {
+                name = key
+            }
+        }
+        parts = append(parts, name)
+    }
+
+    if m.srcPorts != nil {
+        parts = append(parts, "sport " + m.srcPorts.String())
+    }
+
+    if m.dstPorts != nil {
+        parts = append(parts, "dport " + m.dstPorts.String())
+    }
+
+    if m.dscp >= 0 {
+        parts = append(parts, "dscp " + strconv.Itoa(m.dscp))
+    }
+
+    if m.icmpType >= 0 {
+        parts = append(parts, "type " + strconv.Itoa(m.icmpType))
+    }
+
+    if m.icmpCode >= 0 {
+        parts = append(parts, "code " + strconv.Itoa(m.icmpCode))
+    }
+
+    return strings.Join(parts, " ")
+}
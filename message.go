@@ -0,0 +1,118 @@
+// tunnel wire format
+package main
+
+import (
+    "encoding/binary"
+    "net"
+)
+
+/* Every message starts with a one byte type followed by three reserved bytes.
+
+   Handshake initiation
+   0      4          8            40                88               116
+   | type | sender   | ephemeral  | static + tag   | timestamp + tag |
+
+   Handshake response
+   0      4          8            12           44           60
+   | type | sender   | receiver   | ephemeral  | empty + tag |
+
+   Data
+   0      1      2      4            8                16
+   | type | hops | path | receiver   | counter        | sealed payload + tag |
+   The first 16 bytes of a data message are authenticated as associated data.
+   Hops is what is left of the hop limit set by the node the packet entered
+   the tunnels at, path identifies that node; both are zero in keepalives.
+
+   Probe
+   0      4            8                16     17         25
+   | type | receiver   | counter        | kind | sequence | padding | tag |
+   Probes are sealed like data in the same session, kind and sequence encrypted.
+   Path MTU probes are padded with zeros to the size being tested.
+   Rendezvous requests carry the key of the peer looked up, replies carry
+   that key followed by its endpoint, 16 bytes of address and 2 of port.
+*/
+const (
+    MessageInitiation   uint8 = 1
+    MessageResponse     uint8 = 2
+    MessageData         uint8 = 4
+    MessageProbe        uint8 = 5
+)
+
+const (
+    ProbeRequest        uint8 = 1
+    ProbeReply          uint8 = 2
+    ProbeMTURequest     uint8 = 3
+    ProbeMTUReply       uint8 = 4
+    ProbeRendezvousRequest  uint8 = 5
+    ProbeRendezvousReply    uint8 = 6
+)
+
+const (
+    MessageInitiationSize       = 116
+    MessageResponseSize         = 60
+    MessageDataHeaderSize       = 16
+    MessageDataOverhead         = MessageDataHeaderSize + TagSize
+    TimestampSize               = 12
+    ProbeSize                   = 9
+    EndpointSize                = 18
+    TunnelMaxHops               = 8     // default hop limit of packets entering the tunnels
+    LoopLogRate                 = 1.0 / 60  // looped packets logged per second
+)
+
+// outer routing of a packet relayed between tunnels
+type Route struct {
+    Hops    uint8
+    Path    uint16
+}
+
+func appendDataHeader(dst []byte, kind uint8, route Route, index uint32, counter uint64) []byte {
+    var header [MessageDataHeaderSize]byte
+
+    header[0] = kind
+    header[1] = route.Hops
+    binary.BigEndian.PutUint16(header[2:4], route.Path)
+    binary.BigEndian.PutUint32(header[4:8], index)
+    binary.BigEndian.PutUint64(header[8:16], counter)
+
+    return append(dst, header[:]...)
+}
+
+func parseDataHeader(msg []byte) (uint32, uint64) {
+    return binary.BigEndian.Uint32(msg[4:8]), binary.BigEndian.Uint64(msg[8:16])
+}
+
+func parseRoute(msg []byte) Route {
+    return Route{Hops: msg[1], Path: binary.BigEndian.Uint16(msg[2:4])}
+}
+
+func appendProbe(dst []byte, kind uint8, sequence uint64) []byte {
+    dst = append(dst, kind)
+    return binary.BigEndian.AppendUint64(dst, sequence)
+}
+
+func parseProbe(payload []byte) (uint8, uint64) {
+    return payload[0], binary.BigEndian.Uint64(payload[1:ProbeSize])
+}
+
+func appendEndpoint(dst []byte, endpoint *net.UDPAddr) []byte {
+    dst = append(dst, endpoint.IP.To16()...)
+    return binary.BigEndian.AppendUint16(dst, uint16(endpoint.Port))
+}
+
+func parseEndpoint(data []byte) *net.UDPAddr {
+    ip := net.IP(append([]byte{}, data[:net.IPv6len]...))
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+
+    return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[net.IPv6len:EndpointSize]))}
+}
+
+// receiver index of a data, probe or response message
+func messageReceiver(msg []byte) uint32 {
+    if msg[0] == MessageResponse {
+        return binary.BigEndian.Uint32(msg[8:12])
+    }
+
+    return binary.BigEndian.Uint32(msg[4:8])
+}
@@ -0,0 +1,297 @@
+// path MTU handling: fragmentation, too big errors and path MTU discovery
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "strconv"
+    "time"
+)
+
+const (
+    UDPHeaderSize       = 8
+    TunnelOverhead      = IPv6HeaderSize + UDPHeaderSize + MessageDataOverhead
+    DefaultMTU          = 1500 - TunnelOverhead     // the tunnel over IPv6 on an Ethernet path
+    MinMTU              = 576
+    MinMTUIPv6          = 1280  // below which IPv6 cannot be carried (RFC 8200)
+    MaxPacketSize       = 65535
+    IPv4DontFragment    = 0x4000
+    IPv4MoreFragments   = 0x2000
+    PMTUBase            = 1280  // assumed to get through until discovery finds more
+    PMTUInterval        = time.Second
+    PMTUProbeTries      = 3     // probes of a size lost before it is deemed too big
+    PMTUConfirmInterval = 30 * time.Second
+    PMTURaiseInterval   = 10 * time.Minute
+)
+
+var (
+    ErrMTU      = errors.New("MTU must be between 576 and 65535")
+    ErrMTUIPv6  = errors.New("MTU must be at least 1280 to carry IPv6")
+    ErrFragment = errors.New("Packet cannot be fragmented to the MTU")
+)
+
+/* Packetization layer path MTU discovery state of a peer (RFC 8899), held
+   under the peer mutex. Probes padded to a size search between the largest
+   size answered and the smallest one lost, from the base up to the MTU of
+   the engine. Once found, the MTU is confirmed every PMTUConfirmInterval;
+   when that fails it falls back to the base and the search starts over.
+   A larger MTU is searched for again after PMTURaiseInterval.
+*/
+type PathMTU struct {
+    mtu         int         // largest size answered, 0 before discovery
+    high        int         // largest size not known to be lost
+    size        int         // size of the probe in flight
+    sequence    uint64
+    answered    bool
+    tries       int         // probes of size lost in a row
+    probed      time.Time
+    searched    time.Time   // when the search ended, zero while searching
+}
+
+// largest inner packet that gets through to the peer, 0 when not discovered
+func (p *Peer) MTU() int {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.pmtu.mtu
+}
+
+/* Size and sequence of the next discovery probe to peer, size 0 when none
+   is due. The previous probe is accounted for first; changed reports that
+   the search just ended or the MTU fell back to base.
+*/
+func (p *Peer) nextMTUProbe(base int, limit int, now time.Time) (size int, sequence uint64, changed bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    pm := &p.pmtu
+    if pm.mtu == 0 {
+        pm.mtu, pm.high = base, limit
+    }
+
+    // nothing is due between confirmations of a discovered MTU
+    pending := pm.size > 0 && !pm.answered
+    if !pm.searched.IsZero() && !pending && now.Sub(pm.probed) < PMTUConfirmInterval {
+        return 0, 0, false
+    }
+
+    if pending {
+        pm.tries++
+    }
+
+    if pm.tries >= PMTUProbeTries {
+        pm.tries = 0
+
+        if pm.size > pm.mtu {
+            pm.high = pm.size - 1
+        } else {
+            // the discovered MTU no longer gets through
+            pm.mtu, pm.high, pm.searched = base, limit, time.Time{}
+            changed = true
+        }
+    }
+
+    if !pm.searched.IsZero() && now.Sub(pm.searched) >= PMTURaiseInterval {
+        pm.high, pm.searched = limit, time.Time{}
+    }
+
+    switch {
+    case pm.mtu < pm.high:
+        if pm.tries == 0 {
+            pm.size = (pm.mtu + pm.high + 1) / 2
+        }
+    case pm.searched.IsZero():
+        pm.searched, pm.probed, pm.size = now, now, 0
+        return 0, 0, true
+    default:
+        pm.size = pm.mtu
+    }
+
+    pm.sequence++
+    pm.answered = false
+    pm.probed = now
+
+    return pm.size, pm.sequence, changed
+}
+
+// record the reply to a discovery probe
+func (p *Peer) mtuProbeAnswered(sequence uint64) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    pm := &p.pmtu
+    if sequence != pm.sequence || pm.answered {
+        return
+    }
+
+    pm.answered = true
+    pm.tries = 0
+    pm.mtu = max(pm.mtu, pm.size)
+}
+
+// largest packet sent to peer without fragmenting
+func (e *Engine) pathMTU(peer *Peer) int {
+    if peer == nil {
+        return e.mtu
+    }
+
+    // without a session packets go through the relay of the peer, if any
+    if via := e.peers.Relay(peer); via != nil && peer.Session() == nil {
+        peer = via
+    }
+
+    if mtu := peer.MTU(); mtu > 0 {
+        return min(mtu, e.mtu)
+    }
+
+    return e.mtu
+}
+
+// the MTU must fit the IP versions the configuration routes into the tunnels
+func checkMTU(mtu int, conf *EngineConfiguration) (error) {
+    if mtu < MinMTU || mtu > MaxPacketSize {
+        return ErrMTU
+    }
+
+    if mtu < MinMTUIPv6 && conf.CarriesIPv6() {
+        return ErrMTUIPv6
+    }
+
+    return nil
+}
+
+/* Handle a packet over the MTU towards its peer
+   IPv4 packets that may be fragmented are sent in fragments, others are
+   dropped with a rate limited too big error telling the sender the MTU.
+*/
+func (e *Engine) tooBig(dev *NetworkPort, pkt *Packet, reply *Packet, frag *Packet, mtu int) {
+    if !pkt.DontFragment() {
+        if err := Fragment(pkt, mtu, frag, e.ports[NETIO_TUNNEL].netio.Send); err != nil {
+            count(&dev.counters.ErrSend)
+            return
+        }
+
+        count(&dev.counters.Fragmented)
+        count(&dev.counters.Sent)
+        return
+    }
+
+    count(&dev.counters.TooBig)
+
+    if BuildTooBig(pkt, mtu, e.address, reply) && e.icmp.Allow(time.Now()) {
+        e.sendError(dev, pkt, reply)
+    }
+}
+
+// probe the path MTU of the peers with a session
+func (e *Engine) discoverPathMTU() {
+    ticker := time.NewTicker(PMTUInterval)
+    defer ticker.Stop()
+
+    tunnel := e.ports[NETIO_TUNNEL].netio.(*UDPSocket)
+    base := min(PMTUBase, e.mtu)
+
+    for {
+        select {
+        case <-e.ctx.Done():
+            return
+        case now := <-ticker.C:
+            for _, peer := range e.peers.List() {
+                session := peer.Session()
+                if session == nil {
+                    continue
+                }
+
+                size, sequence, changed := peer.nextMTUProbe(base, e.mtu, now)
+                if changed {
+                    Print("Peer " + peer.String() + " path MTU " + strconv.Itoa(peer.MTU()))
+                }
+
+                if size > 0 {
+                    // a probe too big for the local link fails to send, and counts as lost
+                    tunnel.writeProbe(session, ProbeMTURequest, sequence, nil, size)
+                }
+            }
+        }
+    }
+}
+
+/* Split the IPv4 packet pkt into fragments of at most mtu bytes, built in
+   frag and handed to send in order. Options not flagged to be copied are
+   only kept in the first fragment.
+*/
+func Fragment(pkt *Packet, mtu int, frag *Packet, send func(*Packet) error) (error) {
+    var options [60]byte
+
+    size := int(pkt.Data[0] & 0x0f) * 4
+    if size < IPv4HeaderSize || size > int(pkt.Size) {
+        return ErrFragment
+    }
+
+    header := pkt.Data[:size]
+    payload := pkt.Data[size:pkt.Size]
+
+    field := binary.BigEndian.Uint16(pkt.Data[6:8])
+    offset := int(field & 0x1fff) * 8
+    more := field & IPv4MoreFragments
+
+    later := copiedOptions(append(options[:0], header[:IPv4HeaderSize]...), header[IPv4HeaderSize:])
+
+    for len(payload) > 0 {
+        chunk := (mtu - len(header)) &^ 7
+        if chunk <= 0 {
+            return ErrFragment
+        }
+
+        flags := IPv4MoreFragments
+        if len(payload) <= chunk {
+            chunk, flags = len(payload), int(more)
+        }
+
+        data := append(append(frag.Data[:0], header...), payload[:chunk]...)
+        data[0] = 0x40 | byte(len(header) / 4)
+        binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+        binary.BigEndian.PutUint16(data[6:8], uint16(flags | offset / 8))
+        binary.BigEndian.PutUint16(data[10:12], 0)
+        binary.BigEndian.PutUint16(data[10:12], Checksum(0, data[:len(header)]))
+
+        frag.Size = uint16(len(data))
+        frag.Peer, frag.Target, frag.Route = pkt.Peer, pkt.Target, pkt.Route
+
+        if err := send(frag); err != nil {
+            return err
+        }
+
+        payload = payload[chunk:]
+        offset += chunk
+        header = later
+    }
+
+    return nil
+}
+
+// append the options flagged to be copied in every fragment, padded to 32 bits
+func copiedOptions(dst []byte, options []byte) []byte {
+    for len(options) > 0 && options[0] != 0 {
+        size := 1
+        if options[0] != 1 {
+            if len(options) < 2 || options[1] < 2 || int(options[1]) > len(options) {
+                break
+            }
+
+            size = int(options[1])
+        }
+
+        if options[0] & 0x80 != 0 {
+            dst = append(dst, options[:size]...)
+        }
+
+        options = options[size:]
+    }
+
+    for len(dst) % 4 != 0 {
+        dst = append(dst, 0)
+    }
+
+    return dst
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+    "time"
+)
+
+func TestFragment(t *testing.T) {
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+
+    // a copied security option and a record route option, which is not copied
+    pkt.Data = append(pkt.Data, 130, 4, 0, 0, 7, 4, 4, 0)
+    pkt.Data[0] = 0x47
+    for i := 0; i < 1000; i++ {
+        pkt.Data = append(pkt.Data, byte(i))
+    }
+    pkt.Size = uint16(len(pkt.Data))
+
+    frag := &Packet{Data: make([]byte, MaxPacketSize)}
+    payload := []byte{}
+    offset := 0
+
+    err := Fragment(pkt, 400, frag, func(f *Packet) error {
+        data := f.Data[:f.Size]
+        size := int(data[0] & 0x0f) * 4
+        field := binary.BigEndian.Uint16(data[6:8])
+
+        if f.Size > 400 || Checksum(0, data[:size]) != 0 || int(field & 0x1fff) * 8 != offset {
+            t.Fatalf("bad fragment % x", data[:size])
+        }
+
+        if (offset == 0) != (size == 28) || (offset != 0 && size != 24) {
+            t.Fatalf("header of %d bytes at offset %d", size, offset)
+        }
+
+        payload = append(payload, data[size:]...)
+        offset += len(data) - size
+
+        if last := offset == 1000; last != (field & IPv4MoreFragments == 0) {
+            t.Fatalf("more fragments flag at offset %d", offset)
+        }
+
+        return nil
+    })
+
+    if err != nil || !bytes.Equal(payload, pkt.Data[28:]) {
+        t.Fatalf("reassembled %d bytes, %v", len(payload), err)
+    }
+}
+
+func TestPathMTUSearch(t *testing.T) {
+    peer := &Peer{name: "peer"}
+    now := time.Now()
+
+    // the path carries up to 1400 bytes
+    probe := func() (int, bool) {
+        size, sequence, changed := peer.nextMTUProbe(1280, 1420, now)
+        if size > 0 && size <= 1400 {
+            peer.mtuProbeAnswered(sequence)
+        }
+
+        now = now.Add(time.Second)
+        return size, changed
+    }
+
+    for round := 0; round < 100; round++ {
+        if size, changed := probe(); size == 0 {
+            if !changed {
+                t.Fatal("search ended without a change")
+            }
+            break
+        }
+    }
+
+    if peer.MTU() != 1400 {
+        t.Fatalf("path MTU %d", peer.MTU())
+    }
+
+    // the path shrinks: confirmations are lost and the search starts over
+    now = now.Add(PMTUConfirmInterval)
+    for round := 0; round < PMTUProbeTries; round++ {
+        peer.nextMTUProbe(1280, 1420, now)
+        now = now.Add(time.Second)
+    }
+
+    if _, _, changed := peer.nextMTUProbe(1280, 1420, now); !changed || peer.MTU() != 1280 {
+        t.Fatalf("path MTU %d after losing confirmations", peer.MTU())
+    }
+}
+
+func TestTooBig(t *testing.T) {
+    reply := &Packet{Data: make([]byte, 2000)}
+
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, make([]byte, 1480)...)
+    pkt.Size = uint16(len(pkt.Data))
+    pkt.Data[6], pkt.Data[9] = 0x40, 17
+
+    if !pkt.DontFragment() || !BuildTooBig(pkt, 1420, nil, reply) {
+        t.Fatal("no fragmentation needed for a DF packet")
+    }
+
+    message := reply.Data[IPv4HeaderSize:reply.Size]
+    if message[0] != ICMPv4Unreachable || message[1] != ICMPv4FragNeeded || binary.BigEndian.Uint16(message[6:8]) != 1420 {
+        t.Errorf("unexpected reply % x", message[:8])
+    }
+
+    if Checksum(0, message) != 0 {
+        t.Error("bad ICMP checksum")
+    }
+}
+
+func TestMTUIPv6(t *testing.T) {
+    conf := &EngineConfiguration{Address: "10.0.0.1/24", Peers: []PeerEntryFile{{Allowed: []string{"10.1.0.0/16"}}}}
+    if err := checkMTU(1000, conf); err != nil {
+        t.Fatalf("IPv4 only: %v", err)
+    }
+
+    for _, v6 := range []*EngineConfiguration{
+        {Address: "fd00::1/64"},
+        {Peers: []PeerEntryFile{{Allowed: []string{"10.1.0.0/16", "fd00:1::/32"}}}},
+        {Policies: []PolicyEntryFile{{SrcSubnet: "fd00:2::/32", Action: "LOCAL"}}},
+    } {
+        if err := checkMTU(1000, v6); err != ErrMTUIPv6 {
+            t.Fatalf("%+v: %v", v6, err)
+        }
+
+        if err := checkMTU(MinMTUIPv6, v6); err != nil {
+            t.Fatalf("%+v at %d: %v", v6, MinMTUIPv6, err)
+        }
+    }
+
+    e := &Engine{mtu: 1000}
+    if _, err := e.compileEntry(PolicyEntryFile{DstSubnet: "fd00::/8", Action: "LOCAL"}); err != ErrMTUIPv6 {
+        t.Fatalf("IPv6 entry under 1280: %v", err)
+    }
+}
+
+func TestMirrorOverMTU(t *testing.T) {
+    peers, _ := testPeers(t)
+
+    e := &Engine{mtu: 1280}
+
+    tunnel := &testPort{}
+    e.ports[NETIO_TUNNEL].netio = tunnel
+    dev := &e.ports[NETIO_LOCAL]
+    mirror := PolicyAction{egress: NETIO_TUNNEL, peer: peers.ByName("b")}
+
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, make([]byte, 1480)...)
+    pkt.Size = uint16(len(pkt.Data))
+    frag := &Packet{Data: make([]byte, MaxPacketSize)}
+
+    e.mirror(dev, pkt, frag, mirror)
+    if len(tunnel.sent) != 2 || tunnel.sent[0].Size > 1280 {
+        t.Fatalf("%d fragments mirrored", len(tunnel.sent))
+    }
+
+    // DF copies are dropped without telling the sender
+    pkt.Data[6] = 0x40
+    e.mirror(dev, pkt, frag, mirror)
+
+    counters := dev.counters.Snapshot()
+    if len(tunnel.sent) != 2 || counters.Mirrored != 1 || counters.TooBig != 1 {
+        t.Fatalf("sent %d, mirrored %d, too big %d", len(tunnel.sent), counters.Mirrored, counters.TooBig)
+    }
+}
@@ -0,0 +1,161 @@
+// configuration of the TUN device through rtnetlink
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "net"
+    "sync"
+    "syscall"
+)
+
+var ErrNetlinkReply = errors.New("Malformed netlink reply")
+
+/* Socket to the kernel routing subsystem
+   Every request asks for an acknowledgement, which is awaited before the
+   next one is sent, so a failure is reported for the request that caused it.
+*/
+type Netlink struct {
+    mutex       sync.Mutex
+    fd          int
+    sequence    uint32
+    buffer      []byte
+}
+
+func OpenNetlink() (*Netlink, error) {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+        syscall.Close(fd)
+        return nil, err
+    }
+
+    return &Netlink{fd: fd, buffer: make([]byte, syscall.Getpagesize())}, nil
+}
+
+func (n *Netlink) Close() (error) {
+    return syscall.Close(n.fd)
+}
+
+// set the MTU of the link at index and bring it up
+func (n *Netlink) SetLink(index int, mtu int) (error) {
+    msg := make([]byte, syscall.SizeofIfInfomsg)
+    binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+    binary.NativeEndian.PutUint32(msg[8:12], syscall.IFF_UP)
+    binary.NativeEndian.PutUint32(msg[12:16], syscall.IFF_UP)
+    msg = appendAttribute(msg, syscall.IFLA_MTU, binary.NativeEndian.AppendUint32(nil, uint32(mtu)))
+
+    return n.request(syscall.RTM_NEWLINK, 0, msg)
+}
+
+// assign address, with its prefix length, to the link at index
+func (n *Netlink) AddAddress(index int, address *net.IPNet) (error) {
+    family, ip := addressFamily(address.IP)
+    ones, _ := address.Mask.Size()
+
+    msg := []byte{family, byte(ones), 0, syscall.RT_SCOPE_UNIVERSE}
+    msg = binary.NativeEndian.AppendUint32(msg, uint32(index))
+    msg = appendAttribute(msg, syscall.IFA_LOCAL, ip)
+    msg = appendAttribute(msg, syscall.IFA_ADDRESS, ip)
+
+    return n.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE, msg)
+}
+
+// route subnet to the link at index; fails with EEXIST if there is already a route
+func (n *Netlink) AddRoute(index int, subnet *net.IPNet) (error) {
+    return n.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE | syscall.NLM_F_EXCL, routeMessage(index, subnet))
+}
+
+func (n *Netlink) DeleteRoute(index int, subnet *net.IPNet) (error) {
+    return n.request(syscall.RTM_DELROUTE, 0, routeMessage(index, subnet))
+}
+
+// static route of subnet through the link at index, in the main table
+func routeMessage(index int, subnet *net.IPNet) []byte {
+    family, ip := addressFamily(subnet.IP)
+    ones, _ := subnet.Mask.Size()
+
+    // routes without a gateway are link scoped, a scope IPv6 does not use
+    scope := byte(syscall.RT_SCOPE_LINK)
+    if family == syscall.AF_INET6 {
+        scope = syscall.RT_SCOPE_UNIVERSE
+    }
+
+    msg := []byte{family, byte(ones), 0, 0, syscall.RT_TABLE_MAIN, syscall.RTPROT_STATIC, scope, syscall.RTN_UNICAST}
+    msg = binary.NativeEndian.AppendUint32(msg, 0)
+    msg = appendAttribute(msg, syscall.RTA_DST, ip)
+    msg = appendAttribute(msg, syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(index)))
+
+    return msg
+}
+
+// send a request of type kind and wait for its acknowledgement
+func (n *Netlink) request(kind uint16, flags uint16, body []byte) (error) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    n.sequence++
+
+    msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN + len(body))
+    binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN + len(body)))
+    binary.NativeEndian.PutUint16(msg[4:6], kind)
+    binary.NativeEndian.PutUint16(msg[6:8], flags | syscall.NLM_F_REQUEST | syscall.NLM_F_ACK)
+    binary.NativeEndian.PutUint32(msg[8:12], n.sequence)
+    msg = append(msg, body...)
+
+    if err := syscall.Sendto(n.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+        return err
+    }
+
+    for {
+        size, _, err := syscall.Recvfrom(n.fd, n.buffer, 0)
+        if err != nil {
+            return err
+        }
+
+        replies, err := syscall.ParseNetlinkMessage(n.buffer[:size])
+        if err != nil {
+            return err
+        }
+
+        for _, reply := range replies {
+            if reply.Header.Seq != n.sequence || reply.Header.Type != syscall.NLMSG_ERROR {
+                continue
+            }
+
+            if len(reply.Data) < 4 {
+                return ErrNetlinkReply
+            }
+
+            // an acknowledgement is an error message with a zero code
+            if code := int32(binary.NativeEndian.Uint32(reply.Data[0:4])); code != 0 {
+                return syscall.Errno(-code)
+            }
+
+            return nil
+        }
+    }
+}
+
+func appendAttribute(msg []byte, kind uint16, data []byte) []byte {
+    msg = binary.NativeEndian.AppendUint16(msg, uint16(syscall.SizeofRtAttr + len(data)))
+    msg = binary.NativeEndian.AppendUint16(msg, kind)
+    msg = append(msg, data...)
+
+    for len(msg) % syscall.NLMSG_ALIGNTO != 0 {
+        msg = append(msg, 0)
+    }
+
+    return msg
+}
+
+func addressFamily(ip net.IP) (byte, []byte) {
+    if ip4 := ip.To4(); ip4 != nil {
+        return syscall.AF_INET, ip4
+    }
+
+    return syscall.AF_INET6, ip.To16()
+}
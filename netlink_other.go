@@ -0,0 +1,34 @@
+//go:build !linux
+
+package main
+
+import (
+    "net"
+)
+
+// without netlink the TUN device is configured by hand
+type Netlink struct{}
+
+func OpenNetlink() (*Netlink, error) {
+    return nil, ErrNetlinkUnsupported
+}
+
+func (n *Netlink) Close() (error) {
+    return nil
+}
+
+func (n *Netlink) SetLink(index int, mtu int) (error) {
+    return ErrNetlinkUnsupported
+}
+
+func (n *Netlink) AddAddress(index int, address *net.IPNet) (error) {
+    return ErrNetlinkUnsupported
+}
+
+func (n *Netlink) AddRoute(index int, subnet *net.IPNet) (error) {
+    return ErrNetlinkUnsupported
+}
+
+func (n *Netlink) DeleteRoute(index int, subnet *net.IPNet) (error) {
+    return ErrNetlinkUnsupported
+}
@@ -2,19 +2,36 @@
 package main
 
 import (
+    "encoding/binary"
     "net"
+    "water/waterutil"
+)
+
+const (
+    IPv4HeaderSize     = 20
+    IPv6HeaderSize     = 40
+    IPv6FragmentHeader = 44
+    TCPHeaderSize      = 20
+    TCPFlagSYN         = 0x02
+    TCPOptionMSS       = 2
+    MinMSS             = 536
 )
 
 type Packet struct {
     Data        []byte
-    Endpoint    *net.UDPAddr
+    Peer        *Peer   // peer the packet was received from, nil if local
+    Target      *Peer   // peer the packet is sent to
+    Route       Route   // outer routing, as received from or to send to the tunnel
     Size        uint16
 }
 
-// TODO: Add IPv6 support
-
+// a header length under 5 words would put the payload inside the header
 func (pkt *Packet) IsIPv4() bool {
-    return (pkt.Data[0] >> 4) == 4
+    return pkt.Size >= IPv4HeaderSize && (pkt.Data[0] >> 4) == 4 && (pkt.Data[0] & 0x0f) >= 5
+}
+
+func (pkt *Packet) IsIPv6() bool {
+    return pkt.Size >= IPv6HeaderSize && (pkt.Data[0] >> 4) == 6
 }
 
 func (pkt *Packet) GetSourceIPv4() net.IP {
@@ -24,3 +41,187 @@ func (pkt *Packet) GetSourceIPv4() net.IP {
 func (pkt *Packet) GetDestinationIPv4() net.IP {
     return net.IPv4(pkt.Data[16], pkt.Data[17], pkt.Data[18], pkt.Data[19])
 }
+
+func (pkt *Packet) GetSourceIPv6() net.IP {
+    return net.IP(pkt.Data[8:24])
+}
+
+func (pkt *Packet) GetDestinationIPv6() net.IP {
+    return net.IP(pkt.Data[24:40])
+}
+
+// source address of either IP version
+func (pkt *Packet) GetSource() net.IP {
+    if pkt.IsIPv6() {
+        return pkt.GetSourceIPv6()
+    }
+
+    return pkt.GetSourceIPv4()
+}
+
+// destination address of either IP version
+func (pkt *Packet) GetDestination() net.IP {
+    if pkt.IsIPv6() {
+        return pkt.GetDestinationIPv6()
+    }
+
+    return pkt.GetDestinationIPv4()
+}
+
+// IP protocol, or the IPv6 next header; extension headers are not followed
+func (pkt *Packet) Protocol() uint8 {
+    if pkt.IsIPv6() {
+        return pkt.Data[6]
+    }
+
+    return uint8(waterutil.IPv4Protocol(pkt.Data))
+}
+
+// transport header and payload, empty for IPv4 fragments other than the first
+func (pkt *Packet) Payload() []byte {
+    if pkt.IsIPv6() {
+        return pkt.Data[IPv6HeaderSize:pkt.Size]
+    }
+
+    if binary.BigEndian.Uint16(pkt.Data[6:8]) & 0x1fff != 0 {
+        return nil
+    }
+
+    if int(pkt.Data[0] & 0x0f) * 4 > int(pkt.Size) {
+        return nil
+    }
+
+    return waterutil.IPv4Payload(pkt.Data[:pkt.Size])
+}
+
+// IPv4 packets with DF set, which is implied for IPv6
+// part of a fragmented datagram, including its first fragment
+func (pkt *Packet) Fragmented() bool {
+    if pkt.IsIPv6() {
+        return pkt.Protocol() == IPv6FragmentHeader
+    }
+
+    return binary.BigEndian.Uint16(pkt.Data[6:8]) & (IPv4MoreFragments | 0x1fff) != 0
+}
+
+func (pkt *Packet) DontFragment() bool {
+    return pkt.IsIPv6() || binary.BigEndian.Uint16(pkt.Data[6:8]) & IPv4DontFragment != 0
+}
+
+/* Decrement the IPv4 TTL or IPv6 hop limit of a packet forwarded here,
+   updating the IPv4 header checksum incrementally. Returns false, leaving
+   the packet untouched, when it has no hop left to be forwarded.
+*/
+func (pkt *Packet) DecrementTTL() bool {
+    if pkt.IsIPv6() {
+        if pkt.Data[7] <= 1 {
+            return false
+        }
+
+        pkt.Data[7]--
+        return true
+    }
+
+    ttl := waterutil.IPv4TTL(pkt.Data)
+    if ttl <= 1 {
+        return false
+    }
+
+    // TTL and protocol share a 16 bit word of the header
+    old := binary.BigEndian.Uint16(pkt.Data[8:10])
+    pkt.Data[8] = ttl - 1
+    checksum := UpdateChecksum(binary.BigEndian.Uint16(pkt.Data[10:12]), old, binary.BigEndian.Uint16(pkt.Data[8:10]))
+    binary.BigEndian.PutUint16(pkt.Data[10:12], checksum)
+
+    return true
+}
+
+// differentiated services code point, from the IPv6 traffic class
+func (pkt *Packet) DSCP() uint8 {
+    if pkt.IsIPv6() {
+        return ((pkt.Data[0] & 0x0f) << 4 | pkt.Data[1] >> 4) >> 2
+    }
+
+    return waterutil.IPv4DSCP(pkt.Data)
+}
+
+// TCP or UDP ports, valid only when the transport header is present
+func (pkt *Packet) Ports() (uint16, uint16, bool) {
+    if pkt.IsIPv4() {
+        if len(pkt.Payload()) < 4 {
+            return 0, 0, false
+        }
+
+        return waterutil.IPv4SourcePort(pkt.Data), waterutil.IPv4DestinationPort(pkt.Data), true
+    }
+
+    payload := pkt.Payload()
+    if len(payload) < 4 {
+        return 0, 0, false
+    }
+
+    return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]), true
+}
+
+/* Lower the MSS option of a TCP SYN or SYN-ACK to mss, updating the TCP
+   checksum incrementally. Returns whether the packet was changed.
+*/
+func (pkt *Packet) ClampMSS(mss uint16) bool {
+    if pkt.Protocol() != waterutil.TCP {
+        return false
+    }
+
+    segment := pkt.Payload()
+    if len(segment) < TCPHeaderSize || segment[13] & TCPFlagSYN == 0 {
+        return false
+    }
+
+    size := int(segment[12] >> 4) * 4
+    if size < TCPHeaderSize || size > len(segment) {
+        return false
+    }
+
+    for offset := TCPHeaderSize; offset < size && segment[offset] != 0; {
+        if segment[offset] == 1 {
+            offset++
+            continue
+        }
+
+        if offset + 2 > size || segment[offset + 1] < 2 || offset + int(segment[offset + 1]) > size {
+            return false
+        }
+
+        if segment[offset] == TCPOptionMSS && segment[offset + 1] == 4 {
+            return clampOption(segment, offset + 2, mss)
+        }
+
+        offset += int(segment[offset + 1])
+    }
+
+    return false
+}
+
+// write mss at offset of a TCP segment if lower than the value there,
+// updating the checksum over the 16 bit words that changed
+func clampOption(segment []byte, offset int, mss uint16) bool {
+    var old [4]byte
+
+    if binary.BigEndian.Uint16(segment[offset:]) <= mss {
+        return false
+    }
+
+    // an option at an odd offset straddles two words of the checksum
+    start := offset &^ 1
+    end := (offset + 3) &^ 1
+    copy(old[:], segment[start:end])
+
+    binary.BigEndian.PutUint16(segment[offset:], mss)
+
+    checksum := binary.BigEndian.Uint16(segment[16:18])
+    for index := start; index < end; index += 2 {
+        checksum = UpdateChecksum(checksum, binary.BigEndian.Uint16(old[index - start:]), binary.BigEndian.Uint16(segment[index:]))
+    }
+    binary.BigEndian.PutUint16(segment[16:18], checksum)
+
+    return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+)
+
+// TCP checksum of an IPv4 packet, 0 when the one in the segment is right
+func tcpChecksum(pkt *Packet) uint16 {
+    segment := pkt.Payload()
+
+    var sum uint32
+    for index := 12; index < 20; index += 2 {
+        sum += uint32(binary.BigEndian.Uint16(pkt.Data[index:]))
+    }
+
+    return Checksum(sum + uint32(len(segment)) + 6, segment)
+}
+
+func TestHeaderLength(t *testing.T) {
+    pkt := testPacket("10.0.0.1", "10.0.0.2")
+    pkt.Data = append(pkt.Data, make([]byte, 8)...)
+    pkt.Size = uint16(len(pkt.Data))
+
+    if !pkt.IsIPv4() || len(pkt.Payload()) != 8 {
+        t.Fatalf("valid header rejected")
+    }
+
+    for _, ihl := range []byte{0, 4} {
+        pkt.Data[0] = 0x40 | ihl
+        if pkt.IsIPv4() {
+            t.Fatalf("header length %d accepted", ihl)
+        }
+    }
+}
+
+func TestClampMSS(t *testing.T) {
+    for _, options := range [][]byte{
+        {2, 4, 0x05, 0xb4, 1, 1, 1, 0},             // MSS 1460 first
+        {1, 2, 4, 0x05, 0xb4, 1, 1, 0},             // at an odd offset
+    } {
+        pkt := testPacket("10.0.0.1", "10.0.0.2")
+        pkt.Data[9] = 6
+
+        segment := make([]byte, TCPHeaderSize, TCPHeaderSize + len(options))
+        segment[12] = byte(TCPHeaderSize + len(options)) / 4 << 4
+        segment[13] = TCPFlagSYN
+        pkt.Data = append(append(pkt.Data, segment...), options...)
+        pkt.Size = uint16(len(pkt.Data))
+
+        binary.BigEndian.PutUint16(pkt.Data[36:38], tcpChecksum(pkt))
+
+        if !pkt.ClampMSS(1380) || tcpChecksum(pkt) != 0 {
+            t.Fatalf("bad clamp % x", pkt.Data[IPv4HeaderSize:pkt.Size])
+        }
+
+        if pkt.ClampMSS(1400) {
+            t.Fatal("MSS raised")
+        }
+
+        // only SYN packets are clamped
+        pkt.Data[33] = 0x10
+        if pkt.ClampMSS(1300) {
+            t.Fatal("clamped a packet without SYN")
+        }
+    }
+}
+
+func TestIPv6Header(t *testing.T) {
+    pkt := testPacket6("fd00::1", "fd00::2", 17, 0x04, 0xd2, 0, 53, 0, 8, 0, 0)
+    pkt.Data[0], pkt.Data[1] = 0x6b, 0x80   // traffic class 0xb8, DSCP 46
+
+    if !pkt.IsIPv6() || pkt.IsIPv4() {
+        t.Fatal("IPv6 packet not recognized")
+    }
+
+    if !pkt.GetSource().Equal(net.ParseIP("fd00::1")) || !pkt.GetDestination().Equal(net.ParseIP("fd00::2")) {
+        t.Fatalf("addresses %s -> %s", pkt.GetSource(), pkt.GetDestination())
+    }
+
+    if pkt.Protocol() != 17 || len(pkt.Payload()) != 8 || pkt.DSCP() != 46 {
+        t.Fatalf("protocol %d, payload %d, DSCP %d", pkt.Protocol(), len(pkt.Payload()), pkt.DSCP())
+    }
+
+    if src, dst, ok := pkt.Ports(); !ok || src != 1234 || dst != 53 {
+        t.Fatalf("ports %d -> %d, %t", src, dst, ok)
+    }
+
+    if !pkt.DontFragment() || pkt.Fragmented() {
+        t.Fatal("fragmentation flags")
+    }
+
+    if !pkt.DecrementTTL() || pkt.Data[7] != 63 {
+        t.Fatalf("hop limit %d", pkt.Data[7])
+    }
+
+    // too short for the fixed header, or for the ports
+    if short := (&Packet{Data: pkt.Data, Size: IPv6HeaderSize - 1}); short.IsIPv6() {
+        t.Fatal("truncated header accepted")
+    }
+
+    if _, _, ok := testPacket6("fd00::1", "fd00::2", 17, 0x04, 0xd2).Ports(); ok {
+        t.Fatal("ports of a truncated transport header")
+    }
+}
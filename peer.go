@@ -0,0 +1,789 @@
+// remote peers and their sessions
+package main
+
+import (
+    "crypto/ecdh"
+    "errors"
+    "log"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    PeerQueueSize   = 16
+    PeerDownTimeout = 3 * RekeyTimeout  // unanswered handshake after which a peer is down
+)
+
+var (
+    ErrPeerNoSession  = errors.New("No session with peer")
+    ErrPeerNoName     = errors.New("Peer has no name")
+    ErrPeerDuplicate  = errors.New("Duplicate peer name")
+    ErrPeerNoPubkey   = errors.New("Endpoint without peer needs the global pubkey")
+    ErrPeerNoEndpoint = errors.New("Peer endpoint is not known")
+    ErrPeerUnknown    = errors.New("Unknown peer")
+)
+
+type Peer struct {
+    mutex           sync.RWMutex
+    name            string
+    anonymous       bool        // only known by endpoint, not configured
+    remote          *ecdh.PublicKey
+    endpoint        *net.UDPAddr    // learned from authenticated packets
+    configured      string          // endpoint from the configuration, if any
+    allowed         []*net.IPNet
+    handshake       Handshake
+    current         *Session    // confirmed session used for sending
+    previous        *Session    // kept to receive packets in flight during rekey
+    next            *Session    // responder session waiting for confirmation
+    queue           []queued    // packets waiting for a session
+    lastTimestamp   []byte
+    attempt         time.Time   // when the current handshake attempt started
+    lastHandshake   time.Time
+    handshakes      uint32
+    down            bool        // handshake unanswered, cleared by the next session
+    liveness        Liveness
+    pmtu            PathMTU
+    roams           uint32
+    keepalive       time.Duration   // persistent keepalive, 0 when disabled
+    rendezvous      string
+    relay           string
+}
+
+type Peers struct {
+    mutex       sync.RWMutex
+    key         *ecdh.PrivateKey
+    pubkey      *ecdh.PublicKey     // shared by peers only known by endpoint
+    peers       map[string]*Peer
+    keys        map[string]*Peer
+    indices     map[uint32]*Peer
+}
+
+/* Initialize the local identity and the configured peers
+   The global pubkey is optional and only used for policies that
+   name an endpoint instead of a peer.
+*/
+func (ps *Peers) Init(key string, pubkey string, peers []PeerEntryFile) (error) {
+    var peer *Peer
+    var err error
+
+    if ps.key, err = ParsePrivateKey(key); err != nil {
+        return err
+    }
+
+    if pubkey != "" {
+        if ps.pubkey, err = ParsePublicKey(pubkey); err != nil {
+            return err
+        }
+    }
+
+    ps.peers = make(map[string]*Peer)
+    ps.keys = make(map[string]*Peer)
+    ps.indices = make(map[uint32]*Peer)
+
+    for _, entry := range peers {
+        if peer, err = CompilePeer(entry); err != nil {
+            return err
+        }
+
+        if _, found := ps.peers[peer.name]; found {
+            return ErrPeerDuplicate
+        }
+
+        ps.peers[peer.name] = peer
+        ps.keys[string(peer.remote.Bytes())] = peer
+    }
+
+    return nil
+}
+
+func CompilePeer(entry PeerEntryFile) (*Peer, error) {
+    var subnet *net.IPNet
+    var err error
+
+    if entry.Name == "" {
+        return nil, ErrPeerNoName
+    }
+
+    peer := &Peer{name: entry.Name}
+    if peer.remote, err = ParsePublicKey(entry.Pubkey); err != nil {
+        return nil, err
+    }
+
+    if entry.Endpoint != "" {
+        if peer.endpoint, err = net.ResolveUDPAddr("udp", entry.Endpoint); err != nil {
+            return nil, err
+        }
+
+        peer.configured = entry.Endpoint
+    }
+
+    peer.keepalive = time.Duration(entry.Keepalive) * time.Second
+    peer.rendezvous = entry.Rendezvous
+    peer.relay = entry.Relay
+
+    for _, allowed := range entry.Allowed {
+        if _, subnet, err = net.ParseCIDR(allowed); err != nil {
+            return nil, err
+        }
+
+        peer.allowed = append(peer.allowed, subnet)
+    }
+
+    return peer, nil
+}
+
+/* Apply a new list of configured peers
+   1 - peers no longer configured are removed with their sessions
+   2 - new peers are added
+   3 - peers whose key changed are replaced, otherwise endpoint and allowed
+       subnets are updated in place so established sessions survive
+*/
+func (ps *Peers) Reload(entries []PeerEntryFile) (added []string, removed []string, changed []string, err error) {
+    var peer *Peer
+
+    configured := make(map[string]*Peer)
+    for _, entry := range entries {
+        if peer, err = CompilePeer(entry); err != nil {
+            return nil, nil, nil, err
+        }
+
+        if _, found := configured[peer.name]; found {
+            return nil, nil, nil, ErrPeerDuplicate
+        }
+
+        configured[peer.name] = peer
+    }
+
+    for _, old := range ps.List() {
+        if old.anonymous {
+            continue
+        }
+
+        peer, found := configured[old.name]
+        delete(configured, old.name)
+
+        switch {
+        case !found:
+            ps.remove(old)
+            removed = append(removed, old.name)
+
+        case !peer.remote.Equal(old.remote):
+            ps.remove(old)
+            ps.add(peer)
+            changed = append(changed, old.name)
+
+        case old.update(peer):
+            changed = append(changed, old.name)
+        }
+    }
+
+    for name, peer := range configured {
+        ps.add(peer)
+        added = append(added, name)
+    }
+
+    return added, removed, changed, nil
+}
+
+func (ps *Peers) add(peer *Peer) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+
+    ps.peers[peer.name] = peer
+    ps.keys[string(peer.remote.Bytes())] = peer
+}
+
+// forget a peer and every index pointing to it
+func (ps *Peers) remove(peer *Peer) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+
+    delete(ps.peers, peer.name)
+    if ps.keys[string(peer.remote.Bytes())] == peer {
+        delete(ps.keys, string(peer.remote.Bytes()))
+    }
+
+    for index, owner := range ps.indices {
+        if owner == peer {
+            delete(ps.indices, index)
+        }
+    }
+}
+
+// take endpoint and allowed subnets from config, reporting whether anything changed;
+// a learned endpoint is only replaced when the configured one changes
+func (p *Peer) update(config *Peer) bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    modified := len(p.allowed) != len(config.allowed)
+    for index := 0; !modified && index < len(p.allowed); index++ {
+        modified = p.allowed[index].String() != config.allowed[index].String()
+    }
+
+    if config.configured != p.configured {
+        if config.endpoint != nil {
+            p.endpoint = config.endpoint
+        }
+
+        p.configured = config.configured
+        modified = true
+    }
+
+    if p.keepalive != config.keepalive || p.rendezvous != config.rendezvous || p.relay != config.relay {
+        p.keepalive, p.rendezvous, p.relay = config.keepalive, config.rendezvous, config.relay
+        modified = true
+    }
+
+    p.allowed = config.allowed
+    return modified
+}
+
+func (ps *Peers) ByName(name string) *Peer {
+    ps.mutex.RLock()
+    defer ps.mutex.RUnlock()
+
+    return ps.peers[name]
+}
+
+func (ps *Peers) ByKey(key *ecdh.PublicKey) *Peer {
+    ps.mutex.RLock()
+    defer ps.mutex.RUnlock()
+
+    return ps.keys[string(key.Bytes())]
+}
+
+// peer known only by its endpoint, using the global pubkey and allowing any source
+func (ps *Peers) Anonymous(endpoint *net.UDPAddr) (*Peer, error) {
+    if ps.pubkey == nil {
+        return nil, ErrPeerNoPubkey
+    }
+
+    key := endpoint.String()
+
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+
+    peer, found := ps.peers[key]
+    if !found {
+        _, all4, _ := net.ParseCIDR("0.0.0.0/0")
+        _, all6, _ := net.ParseCIDR("::/0")
+        peer = &Peer{name: key, anonymous: true, remote: ps.pubkey, endpoint: endpoint, allowed: []*net.IPNet{all4, all6}}
+        ps.peers[key] = peer
+    }
+
+    return peer, nil
+}
+
+func (ps *Peers) ByIndex(index uint32) *Peer {
+    ps.mutex.RLock()
+    defer ps.mutex.RUnlock()
+
+    return ps.indices[index]
+}
+
+// addresses the tunnel traffic is sent to
+func (ps *Peers) Endpoints() []net.IP {
+    endpoints := []net.IP{}
+    for _, peer := range ps.List() {
+        if endpoint := peer.Endpoint(); endpoint != nil {
+            endpoints = append(endpoints, endpoint.IP)
+        }
+    }
+
+    return endpoints
+}
+
+func (ps *Peers) List() []*Peer {
+    ps.mutex.RLock()
+    defer ps.mutex.RUnlock()
+
+    list := make([]*Peer, 0, len(ps.peers))
+    for _, peer := range ps.peers {
+        list = append(list, peer)
+    }
+
+    return list
+}
+
+// allocate an unused local index for a handshake or session
+func (ps *Peers) newIndex(peer *Peer) uint32 {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+
+    for {
+        index := randomUint32()
+        if _, found := ps.indices[index]; !found && index != 0 {
+            ps.indices[index] = peer
+            return index
+        }
+    }
+}
+
+func (ps *Peers) releaseIndex(index uint32) {
+    if index == 0 {
+        return
+    }
+
+    ps.mutex.Lock()
+    delete(ps.indices, index)
+    ps.mutex.Unlock()
+}
+
+// start a handshake with peer unless one is already in flight;
+// returns the initiation message to send, or nil
+func (ps *Peers) Initiate(peer *Peer, now time.Time) ([]byte, error) {
+    peer.mutex.Lock()
+    defer peer.mutex.Unlock()
+
+    return ps.initiate(peer, now)
+}
+
+func (ps *Peers) initiate(peer *Peer, now time.Time) ([]byte, error) {
+    hs := &peer.handshake
+
+    if hs.ephemeral != nil && now.Sub(hs.started) < RekeyTimeout {
+        return nil, nil
+    }
+
+    if hs.ephemeral == nil {
+        peer.attempt = now
+    }
+
+    ps.releaseIndex(hs.local)
+    return hs.CreateInitiation(ps.key, peer.remote, ps.newIndex(peer))
+}
+
+// handle an initiation as responder, returning the peer and the response message
+func (ps *Peers) ConsumeInitiation(msg []byte, endpoint *net.UDPAddr) (*Peer, []byte, error) {
+    var hs Handshake
+    var ts, response []byte
+    var session *Session
+    var err error
+
+    if ts, err = hs.ConsumeInitiation(ps.key, msg); err != nil {
+        return nil, nil, err
+    }
+
+    peer := ps.ByKey(hs.remoteStatic)
+    if peer == nil {
+        if ps.pubkey == nil || !hs.remoteStatic.Equal(ps.pubkey) {
+            return nil, nil, ErrHandshakeUnknown
+        }
+
+        if peer, err = ps.Anonymous(endpoint); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    peer.mutex.Lock()
+    defer peer.mutex.Unlock()
+
+    if !newerTimestamp(ts, peer.lastTimestamp) {
+        return nil, nil, ErrHandshakeReplay
+    }
+
+    index := ps.newIndex(peer)
+    if response, err = hs.CreateResponse(index); err != nil {
+        ps.releaseIndex(index)
+        return nil, nil, err
+    }
+
+    if session, err = hs.Session(peer, false); err != nil {
+        ps.releaseIndex(index)
+        return nil, nil, err
+    }
+
+    // the session is only used for sending once the initiator confirms it
+    if peer.next != nil {
+        ps.releaseIndex(peer.next.local)
+    }
+
+    peer.next = session
+    peer.lastTimestamp = ts
+    peer.down = false
+    peer.roam(endpoint)
+    peer.lastHandshake = time.Now()
+    peer.handshakes++
+
+    return peer, response, nil
+}
+
+// handle a response as initiator, returning the peer and its new session
+func (ps *Peers) ConsumeResponse(msg []byte) (*Peer, *Session, error) {
+    var session *Session
+    var err error
+
+    peer := ps.ByIndex(messageReceiver(msg))
+    if peer == nil {
+        return nil, nil, ErrHandshakeInvalid
+    }
+
+    peer.mutex.Lock()
+    defer peer.mutex.Unlock()
+
+    hs := peer.handshake
+    if err = hs.ConsumeResponse(ps.key, msg); err != nil {
+        return nil, nil, err
+    }
+
+    if session, err = hs.Session(peer, true); err != nil {
+        return nil, nil, err
+    }
+
+    // the index now belongs to the session
+    peer.handshake = Handshake{}
+    ps.rotate(peer, session)
+    peer.lastHandshake = time.Now()
+    peer.handshakes++
+
+    return peer, session, nil
+}
+
+// find the session a data message is addressed to
+func (ps *Peers) Session(msg []byte) (*Session) {
+    index := messageReceiver(msg)
+
+    peer := ps.ByIndex(index)
+    if peer == nil {
+        return nil
+    }
+
+    peer.mutex.RLock()
+    defer peer.mutex.RUnlock()
+
+    for _, session := range []*Session{peer.current, peer.next, peer.previous} {
+        if session != nil && session.local == index {
+            return session
+        }
+    }
+
+    return nil
+}
+
+// first data received on a pending responder session confirms it
+func (ps *Peers) Confirm(session *Session) {
+    peer := session.peer
+
+    peer.mutex.Lock()
+    defer peer.mutex.Unlock()
+
+    if peer.next == session {
+        peer.next = nil
+        ps.rotate(peer, session)
+    }
+}
+
+// make session current, keeping the old one to drain in-flight packets
+func (ps *Peers) rotate(peer *Peer, session *Session) {
+    if peer.previous != nil {
+        ps.releaseIndex(peer.previous.local)
+    }
+
+    peer.previous = peer.current
+    peer.current = session
+    peer.down = false
+}
+
+/* Periodic session maintenance
+   1 - drop expired sessions and release their indices
+   2 - mark peers down once a handshake has gone unanswered for PeerDownTimeout
+   3 - abandon handshakes that never completed, with their queued packets
+   4 - return initiations to retransmit for peers still waiting for a session,
+       and the sessions of peers with a persistent keepalive that went quiet,
+       with an initiation when such a session is due for a rekey
+*/
+func (ps *Peers) Maintain(now time.Time) (map[*Peer][]byte, []*Session) {
+    var keepalives []*Session
+
+    retransmit := make(map[*Peer][]byte)
+
+    for _, peer := range ps.List() {
+        peer.mutex.Lock()
+
+        for _, session := range []**Session{&peer.current, &peer.previous, &peer.next} {
+            if *session != nil && (*session).Expired(now) {
+                ps.releaseIndex((*session).local)
+                *session = nil
+            }
+        }
+
+        hs := &peer.handshake
+        if hs.ephemeral != nil && now.Sub(peer.attempt) > PeerDownTimeout {
+            peer.down = true
+        }
+
+        if hs.ephemeral != nil && now.Sub(hs.started) > RekeyTimeout {
+            if now.Sub(peer.attempt) > RekeyAttemptTime {
+                ps.releaseIndex(hs.local)
+                *hs = Handshake{}
+                peer.queue = nil
+            } else if msg, err := ps.initiate(peer, now); err == nil && msg != nil {
+                retransmit[peer] = msg
+            }
+        }
+
+        // persistent keepalives hold NAT mappings open, with a handshake if need be
+        if peer.keepalive > 0 && peer.endpoint != nil {
+            if peer.current != nil && peer.current.Quiet(now, peer.keepalive) {
+                keepalives = append(keepalives, peer.current)
+
+                // keepalives are sent without going through send, which starts the rekey of data
+                if peer.current.NeedsRekey(now) {
+                    if msg, err := ps.initiate(peer, now); err == nil && msg != nil {
+                        retransmit[peer] = msg
+                    }
+                }
+            } else if peer.current == nil && hs.ephemeral == nil {
+                if msg, err := ps.initiate(peer, now); err == nil && msg != nil {
+                    retransmit[peer] = msg
+                }
+            }
+        }
+
+        peer.mutex.Unlock()
+    }
+
+    return retransmit, keepalives
+}
+
+/* Take addr as the endpoint of the peer, with the peer lock held
+   Only called for authenticated, non replayed messages, so an attacker
+   can only redirect traffic to where the peer actually sends from.
+   Peers only known by endpoint keep it. Returns whether it changed.
+*/
+func (p *Peer) roam(addr *net.UDPAddr) bool {
+    if p.anonymous || addr == nil {
+        return false
+    }
+
+    if p.endpoint != nil && p.endpoint.IP.Equal(addr.IP) && p.endpoint.Port == addr.Port {
+        return false
+    }
+
+    if p.endpoint != nil {
+        Print("Peer " + p.name + " roamed from " + p.endpoint.String() + " to " + addr.String())
+        p.roams++
+    }
+
+    p.endpoint = addr
+    return true
+}
+
+// learn the endpoint of the peer from an authenticated message
+func (p *Peer) Roam(addr *net.UDPAddr) bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    return p.roam(addr)
+}
+
+// peer relaying to p while there is no direct session, nil if none
+func (ps *Peers) Relay(p *Peer) *Peer {
+    p.mutex.RLock()
+    name := p.relay
+    p.mutex.RUnlock()
+
+    if name == "" || name == p.name {
+        return nil
+    }
+
+    return ps.ByName(name)
+}
+
+// endpoint given by a rendezvous node, not authenticated but only used
+// to send handshakes that the real peer alone can answer
+func (p *Peer) SetEndpoint(addr *net.UDPAddr) bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if p.endpoint != nil && p.endpoint.String() == addr.String() {
+        return false
+    }
+
+    p.endpoint = addr
+    return true
+}
+
+// without any session or handshake in progress
+func (p *Peer) Idle() bool {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.current == nil && p.previous == nil && p.next == nil && p.handshake.ephemeral == nil
+}
+
+func (p *Peer) Endpoint() *net.UDPAddr {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.endpoint
+}
+
+// cryptokey routing: a peer may only send from its allowed subnets
+func (p *Peer) Allows(ip net.IP) bool {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    for _, subnet := range p.allowed {
+        if subnet.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (p *Peer) String() string {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.describe()
+}
+
+// name and endpoint, with the peer lock held
+func (p *Peer) describe() string {
+    if p.endpoint == nil || p.endpoint.String() == p.name {
+        return p.name
+    }
+
+    return p.name + " (" + p.endpoint.String() + ")"
+}
+
+// a down peer is avoided by load balancing and failover until a handshake
+// completes and, when it is probed, until it answers probes again
+func (p *Peer) Down() bool {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.down || p.liveness.failed
+}
+
+// session used for sending, nil if none is usable
+func (p *Peer) Session() *Session {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    return p.current
+}
+
+type queued struct {
+    data    []byte
+    route   Route
+}
+
+// keep a copy of a packet until a session is established
+func (p *Peer) Enqueue(data []byte, route Route) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if len(p.queue) >= PeerQueueSize {
+        p.queue = p.queue[1:]
+    }
+
+    p.queue = append(p.queue, queued{data: append([]byte{}, data...), route: route})
+}
+
+func (p *Peer) Dequeue() []queued {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    queue := p.queue
+    p.queue = nil
+
+    return queue
+}
+
+func (ps *Peers) DumpSessions() {
+    now := time.Now()
+    Print("Peer sessions:")
+
+    for _, peer := range ps.List() {
+        peer.mutex.RLock()
+
+        log.Println(peer.describe() + ":")
+        log.Println("\tHandshakes:\t", peer.handshakes)
+        if !peer.lastHandshake.IsZero() {
+            log.Println("\tLast handshake:\t", now.Sub(peer.lastHandshake).Round(time.Second), "ago")
+        }
+        log.Println("\tQueued:\t\t", len(peer.queue))
+        if peer.roams > 0 {
+            log.Println("\tRoams:\t\t", peer.roams)
+        }
+        if peer.liveness.sent > 0 {
+            log.Println("\tProbes:\t\t", peer.liveness.String())
+        }
+        if peer.down || peer.liveness.failed {
+            log.Println("\tDown")
+        }
+
+        names := []string{"current", "previous", "pending"}
+        for index, session := range []*Session{peer.current, peer.previous, peer.next} {
+            if session == nil {
+                continue
+            }
+
+            log.Println("\tSession " + names[index] + ":\t",
+                strconv.FormatUint(uint64(session.local), 16) + "/" + strconv.FormatUint(uint64(session.remote), 16),
+                "age", now.Sub(session.created).Round(time.Second),
+                "rx", session.rxBytes.Load(), "tx", session.txBytes.Load())
+        }
+
+        peer.mutex.RUnlock()
+    }
+}
+
+// state of a peer as reported by the control API
+type PeerInfo struct {
+    Name            string      `json:"name"`
+    Pubkey          string      `json:"pubkey"`
+    Endpoint        string      `json:"endpoint,omitempty"`
+    Allowed         []string    `json:"allowed"`
+    Handshakes      uint32      `json:"handshakes"`
+    LastHandshake   time.Time   `json:"last_handshake"`
+    Session         bool        `json:"session"`
+    Down            bool        `json:"down"`
+    ProbesSent      uint32      `json:"probes_sent"`
+    ProbesAnswered  uint32      `json:"probes_answered"`
+    Roams           uint32      `json:"roams"`
+    Keepalive       int         `json:"keepalive,omitempty"`
+    Relay           string      `json:"relay,omitempty"`
+    Relayed         bool        `json:"relayed"`
+    Queued          int         `json:"queued"`
+    MTU             int         `json:"mtu,omitempty"`
+}
+
+func (p *Peer) Info() PeerInfo {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+
+    info := PeerInfo{
+        Name:           p.name,
+        Pubkey:         EncodePublicKey(p.remote),
+        Allowed:        []string{},
+        Handshakes:     p.handshakes,
+        LastHandshake:  p.lastHandshake,
+        Session:        p.current != nil,
+        Down:           p.down || p.liveness.failed,
+        ProbesSent:     p.liveness.sent,
+        ProbesAnswered: p.liveness.received,
+        Roams:          p.roams,
+        Keepalive:      int(p.keepalive / time.Second),
+        Relay:          p.relay,
+        Relayed:        p.relay != "" && p.current == nil,
+        Queued:         len(p.queue),
+        MTU:            p.pmtu.mtu,
+    }
+
+    if p.endpoint != nil {
+        info.Endpoint = p.endpoint.String()
+    }
+
+    for _, subnet := range p.allowed {
+        info.Allowed = append(info.Allowed, subnet.String())
+    }
+
+    return info
+}
@@ -4,46 +4,146 @@ import (
     "log"
     "net"
     "errors"
+    "slices"
+    "sort"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    LookupFirstMatch    = "first"
+    LookupLongestPrefix = "lpm"
+    PolicyMainTable     = "main"
+    PolicyMaxJumps      = 8
 )
 
 var (
+    ErrPolicyLookupMode   = errors.New("Unknown policy lookup mode")
     ErrPolicyEmptyMatch   = errors.New("Match criteria is not defined")
     ErrPolicyEmptyAction  = errors.New("Action is node defined")
     ErrPolicyIndexInvalid = errors.New("Index out of bound")
+    ErrPolicyNoPeer       = errors.New("Forwarding needs a peer or an endpoint")
+    ErrPolicyNoTarget     = errors.New("Jump needs a target table")
+    ErrPolicyDuplicate    = errors.New("Duplicate policy entry name")
+    ErrPolicyUnknownName  = errors.New("Unknown policy entry name")
+    ErrPolicyMSS          = errors.New("MSS must be between 536 and 65535")
+    ErrPolicyDefault      = errors.New("Default action must be DROP or REJECT")
+    ErrPolicyNoCapture    = errors.New("Mirror without peer or endpoint needs a capture file")
 )
 
 type PolicyMatch struct {
     dstSubnet   *net.IPNet
     srcSubnet   *net.IPNet
+    transport   TransportMatch
 }
 
 type PolicyAction struct {
     egress      uint8
-    endpoint    *net.UDPAddr
+    peer        *Peer
+    group       *NextHopGroup   // load balanced next hops in place of peer
+    failover    *Failover       // peer as primary with a backup
+    jump        string      // table evaluated in place of a final action
+    reject      uint8       // reason of the unreachable sent back, RejectNone to stay silent
+    mirror      bool        // copy to egress and peer, evaluation goes on
+    transit     bool        // packets from the tunnel may be forwarded to it again
+    mss         uint16      // TCP MSS clamped on SYN packets, 0 to leave them alone
 }
 
 type PolicyEntry struct {
+    Name   string
+    Table  string
+    Priority int
     Match  PolicyMatch
     Action PolicyAction
     TimeToLive  int
+    Refresh bool
+    expires atomic.Int64    // unix nanoseconds, only set with a TimeToLive
+    Source PolicyEntryFile
 }
 
+/* Rules are published as immutable snapshots: lookups load the current
+   slice without locking, while writers serialize on the mutex, copy the
+   slice, modify the copy and swap it in. Entries are never modified
+   once published, except for their atomic expiry time, so a lookup in
+   progress keeps a consistent view.
+
+   Entries belong to named tables, evaluation starts in the main table.
+   Within a table entries are ordered by priority, lowest first, and then
+   by their position in the rules. A JUMP entry evaluates its target table
+   and, when nothing matches there, evaluation continues after the jump.
+   A MIRROR entry sends a copy of the packet to its peer or endpoint, or to
+   the capture port when it has neither, and evaluation continues as well.
+   Each table is evaluated either in order, returning the first match, or
+   by longest destination prefix through RouteTables built with the snapshot,
+   one per priority so that priority takes precedence over prefix length.
+*/
 type Policy struct {
-	rules []PolicyEntry
+    mutex    sync.Mutex
+    lpm      bool
+    fallback PolicyAction
+	rules atomic.Pointer[policySnapshot]
+}
+
+type policySnapshot struct {
+    rules    []*PolicyEntry
+    tables   map[string]*policyTable
+    fallback PolicyAction   // applied when no entry matches
+    lpm      bool           // tables are evaluated through their routes
+}
+
+type policyTable struct {
+    rules  []*PolicyEntry   // effective evaluation order
+    routes []*RouteTable    // by priority, only for longest prefix match
+}
+
+// entry as reported by the control API, in effective order
+type PolicyView struct {
+    Index int `json:"index"`   // position used to delete or move the entry
+    PolicyEntryFile
+}
+
+// compile a policy entry and append it to the rules
+func (p *Policy) CompilePolicy(pol PolicyEntryFile, peers *Peers) (error) {
+    var entry *PolicyEntry
+    var err error
+
+    if entry, err = CompileEntry(pol, peers); err != nil {
+        return err
+    }
+
+    return p.Insert(-1, entry)
+}
+
+/* Compile a policy entry, resolving its peers
+   Endpoints create peers, so the entry is first compiled without creating
+   any: an entry that fails leaves the peers as they were.
+*/
+func CompileEntry(pol PolicyEntryFile, peers *Peers) (*PolicyEntry, error) {
+    if _, err := compileEntry(pol, peers, false); err != nil {
+        return nil, err
+    }
+
+    return compileEntry(pol, peers, true)
 }
 
-func (p *Policy) CompilePolicy(pol PolicyEntryFile) (error) {
+// compile pol, registering the peers of its endpoints when register is set
+func compileEntry(pol PolicyEntryFile, peers *Peers, register bool) (*PolicyEntry, error) {
     var subnet *net.IPNet
-    var endpoint *net.UDPAddr
+    var peer *Peer
     var err error
 
-    entry := PolicyEntry{}
+    entry := &PolicyEntry{Name: pol.Name, Table: pol.Table, Priority: pol.Priority, Source: pol}
+    if entry.Table == "" {
+        entry.Table = PolicyMainTable
+    }
 
     if pol.DstSubnet != "" {
         if _, subnet, err = net.ParseCIDR(pol.DstSubnet); err != nil {
             // TODO: log and continue
-            return err
+            return nil, err
         }
 
         entry.Match.dstSubnet = subnet
@@ -52,89 +152,661 @@ func (p *Policy) CompilePolicy(pol PolicyEntryFile) (error) {
     if pol.SrcSubnet != "" {
         if _, subnet, err = net.ParseCIDR(pol.SrcSubnet); err != nil {
             //TODO: log and continue
-            return err
+            return nil, err
         }
 
         entry.Match.srcSubnet = subnet
     }
 
-    if pol.Endpoint != "" {
-        if endpoint, err = net.ResolveUDPAddr("udp4", pol.Endpoint); err != nil {
-            return err
+    if entry.Match.transport, err = CompileTransportMatch(pol); err != nil {
+        return nil, err
+    }
+
+    if peer, err = resolvePeer(pol.Peer, pol.Endpoint, peers, register); err != nil {
+        return nil, err
+    }
+
+    if len(pol.NextHops) > 0 {
+        if pol.Action != "FORWARD" {
+            return nil, ErrNextHopAction
+        }
+
+        if entry.Action.group, err = CompileNextHops(pol.NextHops, peers, register); err != nil {
+            return nil, err
+        }
+    }
+
+    if pol.Backup != "" || pol.BackupEndpoint != "" {
+        if entry.Action.failover, err = compileFailover(pol, peer, peers, register); err != nil {
+            return nil, err
         }
     }
 
     switch pol.Action {
     case "LOCAL"    : entry.Action.egress = NETIO_LOCAL
     case "FORWARD"  : entry.Action.egress = NETIO_TUNNEL
+    case "JUMP"     : entry.Action.jump = pol.Target
+    case "REJECT"   : entry.Action.egress = NETIO_DROP
+                      entry.Action.reject, err = parseRejectReason(pol.Reject)
+    case "MIRROR"   : entry.Action.egress = NETIO_CAPTURE
+                      entry.Action.mirror = true
     default         : entry.Action.egress = NETIO_DROP
     }
 
-    entry.Action.endpoint = endpoint
+    if entry.Action.mirror && peer != nil {
+        entry.Action.egress = NETIO_TUNNEL
+    }
 
-    p.rules = append(p.rules, entry)
-    return nil
+    if err != nil {
+        return nil, err
+    }
+
+    if pol.Action == "JUMP" && pol.Target == "" {
+        return nil, ErrPolicyNoTarget
+    }
+
+    if entry.Action.egress == NETIO_TUNNEL && peer == nil && entry.Action.group == nil {
+        return nil, ErrPolicyNoPeer
+    }
+
+    entry.Action.peer = peer
+    entry.Action.transit = pol.Transit
+
+    if pol.MSS != 0 {
+        if pol.MSS < MinMSS || pol.MSS > MaxPacketSize {
+            return nil, ErrPolicyMSS
+        }
+
+        entry.Action.mss = uint16(pol.MSS)
+    }
+
+    if pol.TTL > 0 {
+        entry.TimeToLive = pol.TTL
+        entry.Refresh = pol.Refresh
+        entry.refresh(time.Now())
+    }
+
+    return entry, nil
 }
 
+/* Peer of a policy by name or endpoint, a named peer taking precedence; nil
+   if neither is set. Without register, the peer of an endpoint is only
+   checked and a stand-in returned.
+*/
+func resolvePeer(name string, address string, peers *Peers, register bool) (*Peer, error) {
+    var endpoint *net.UDPAddr
+    var err error
 
-func (p *Policy) Lookup(pkt *Packet) (PolicyAction, bool) {
+    if name != "" {
+        if peer := peers.ByName(name); peer != nil {
+            return peer, nil
+        }
 
-    for _, entry := range p.rules {
-        if (entry.Match.dstSubnet != nil) && (!entry.Match.dstSubnet.Contains(pkt.GetDestinationIPv4())) {
+        return nil, ErrPeerUnknown
+    }
+
+    if address == "" {
+        return nil, nil
+    }
+
+    if endpoint, err = net.ResolveUDPAddr("udp", address); err != nil {
+        return nil, err
+    }
+
+    if !register {
+        if peers.pubkey == nil {
+            return nil, ErrPeerNoPubkey
+        }
+
+        return &Peer{name: endpoint.String(), anonymous: true}, nil
+    }
+
+    return peers.Anonymous(endpoint)
+}
+
+func compileFailover(pol PolicyEntryFile, primary *Peer, peers *Peers, register bool) (*Failover, error) {
+    if pol.Action != "FORWARD" || primary == nil {
+        return nil, ErrFailoverAction
+    }
+
+    backup, err := resolvePeer(pol.Backup, pol.BackupEndpoint, peers, register)
+    if err != nil {
+        return nil, err
+    }
+
+    return NewFailover(primary, backup), nil
+}
+
+// peers the entry sends to, with nil when it has none
+func (entry *PolicyEntry) peers() []*Peer {
+    peers := []*Peer{entry.Action.peer}
+    if entry.Action.group != nil {
+        peers = entry.Action.group.Peers()
+    }
+
+    if entry.Action.failover != nil {
+        peers = append(peers, entry.Action.failover.backup)
+    }
+
+    return peers
+}
+
+// push the expiry of a TTL entry to a full TimeToLive from now
+func (entry *PolicyEntry) refresh(now time.Time) {
+    entry.expires.Store(now.Add(time.Duration(entry.TimeToLive) * time.Second).UnixNano())
+}
+
+func (entry *PolicyEntry) Expired(now time.Time) bool {
+    return entry.TimeToLive > 0 && now.UnixNano() > entry.expires.Load()
+}
+
+
+// current snapshot of the rules, never modified
+func (p *Policy) snapshot() []*PolicyEntry {
+    if current := p.rules.Load(); current != nil {
+        return current.rules
+    }
+
+    return nil
+}
+
+/* Destinations of the FORWARD entries in the main table and the tables
+   it jumps to. Routing a prefix containing one of the peer endpoints to
+   the device would send the tunnel traffic itself into it, such prefixes
+   are returned as skipped.
+*/
+func (s *policySnapshot) forwardedSubnets(endpoints []net.IP) (subnets []*net.IPNet, skipped []*net.IPNet) {
+    reached := map[string]bool{PolicyMainTable: true}
+    pending := []string{PolicyMainTable}
+
+    for len(pending) > 0 {
+        table := s.tables[pending[0]]
+        pending = pending[1:]
+        if table == nil {
             continue
         }
 
-        if (entry.Match.srcSubnet != nil) && (!entry.Match.srcSubnet.Contains(pkt.GetSourceIPv4())) {
+        for _, entry := range table.rules {
+            if jump := entry.Action.jump; jump != "" && !reached[jump] {
+                reached[jump] = true
+                pending = append(pending, jump)
+            }
+
+            subnet := entry.Match.dstSubnet
+            if entry.Action.egress != NETIO_TUNNEL || entry.Action.mirror || subnet == nil {
+                continue
+            }
+
+            // a default route to the device would take the tunnel traffic itself
+            if ones, _ := subnet.Mask.Size(); ones == 0 {
+                continue
+            }
+
+            if slices.ContainsFunc(endpoints, subnet.Contains) {
+                skipped = append(skipped, subnet)
+                continue
+            }
+
+            subnets = append(subnets, subnet)
+        }
+    }
+
+    return subnets, skipped
+}
+
+// run update on a private copy of the rules and publish the result
+func (p *Policy) update(update func([]*PolicyEntry) ([]*PolicyEntry, error)) (error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    rules, err := update(append([]*PolicyEntry{}, p.snapshot()...))
+    if err != nil {
+        return err
+    }
+
+    p.publish(rules)
+    return nil
+}
+
+// with the mutex held
+func (p *Policy) publish(rules []*PolicyEntry) {
+    next := &policySnapshot{rules: rules, tables: make(map[string]*policyTable), fallback: p.fallback, lpm: p.lpm}
+
+    for _, entry := range rules {
+        table := next.tables[entry.Table]
+        if table == nil {
+            table = &policyTable{}
+            next.tables[entry.Table] = table
+        }
+
+        table.rules = append(table.rules, entry)
+    }
+
+    for _, table := range next.tables {
+        sort.SliceStable(table.rules, func(i, j int) bool {
+            return table.rules[i].Priority < table.rules[j].Priority
+        })
+
+        if !p.lpm {
             continue
         }
 
+        for start, end := 0, 0; start < len(table.rules); start = end {
+            for end = start; end < len(table.rules) && table.rules[end].Priority == table.rules[start].Priority; end++ {
+            }
+
+            table.routes = append(table.routes, NewRouteTable(table.rules[start:end]))
+        }
+    }
+
+    p.rules.Store(next)
+}
+
+// names of the tables, main first
+func (s *policySnapshot) tableNames() []string {
+    names := []string{}
+    for name := range s.tables {
+        if name != PolicyMainTable {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    if _, found := s.tables[PolicyMainTable]; found {
+        names = append([]string{PolicyMainTable}, names...)
+    }
+
+    return names
+}
+
+// first entry of a table with a final action matching pkt, collecting mirrors on the way
+func (s *policySnapshot) lookup(name string, pkt *Packet, jumps int, mirrors *[]PolicyAction) *PolicyEntry {
+    var result *PolicyEntry
+
+    table := s.tables[name]
+    if table == nil {
+        return nil
+    }
+
+    visit := func(entry *PolicyEntry) bool {
+        if entry.Action.mirror {
+            if mirrors != nil {
+                *mirrors = append(*mirrors, entry.Action)
+            }
+
+            return false
+        }
+
+        if entry.Action.jump == "" {
+            result = entry
+            return true
+        }
+
+        // a jump that finds nothing falls through to the next entry
+        if jumps < PolicyMaxJumps {
+            result = s.lookup(entry.Action.jump, pkt, jumps + 1, mirrors)
+        }
+
+        return result != nil
+    }
+
+    if table.routes != nil {
+        for _, route := range table.routes {
+            if route.Walk(pkt, visit); result != nil {
+                break
+            }
+        }
+
+        return result
+    }
+
+    for _, entry := range table.rules {
+        if entry.Matches(pkt) && visit(entry) {
+            break
+        }
+    }
+
+    return result
+}
+
+// select how rules are evaluated, see LookupFirstMatch and LookupLongestPrefix
+func (p *Policy) SetLookup(mode string) (error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    switch mode {
+    case "", LookupFirstMatch   : p.lpm = false
+    case LookupLongestPrefix    : p.lpm = true
+    default                     : return ErrPolicyLookupMode
+    }
+
+    p.publish(p.snapshot())
+    return nil
+}
+
+// action for packets matching no entry: DROP, the default, or REJECT
+func (p *Policy) SetDefault(action string) (error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    switch action {
+    case "", "DROP" : p.fallback = PolicyAction{egress: NETIO_DROP}
+    case "REJECT"   : p.fallback = PolicyAction{egress: NETIO_DROP, reject: RejectAdmin}
+    default         : return ErrPolicyDefault
+    }
+
+    p.publish(p.snapshot())
+    return nil
+}
+
+// action of the matching entry, or the default action and false
+func (p *Policy) Lookup(pkt *Packet) (PolicyAction, bool) {
+    return p.LookupMirrors(pkt, nil)
+}
+
+// Lookup that also appends the actions of the matching MIRROR entries to mirrors
+func (p *Policy) LookupMirrors(pkt *Packet, mirrors *[]PolicyAction) (PolicyAction, bool) {
+    current := p.rules.Load()
+    if current == nil {
+        return PolicyAction{egress: NETIO_DROP}, false
+    }
+
+    if entry := current.lookup(PolicyMainTable, pkt, 0, mirrors); entry != nil {
         return entry.Action, true
     }
 
-    return PolicyAction{}, false
+    return current.fallback, false
 }
 
+func (entry *PolicyEntry) Matches(pkt *Packet) bool {
+    if (entry.Match.dstSubnet != nil) && (!entry.Match.dstSubnet.Contains(pkt.GetDestination())) {
+        return false
+    }
 
-func (p *Policy) DumpPolicies() {
-    var output string
+    if (entry.Match.srcSubnet != nil) && (!entry.Match.srcSubnet.Contains(pkt.GetSource())) {
+        return false
+    }
+
+    if !entry.Match.transport.Matches(pkt) {
+        return false
+    }
+
+    // expired entries stop matching before the reaper removes them,
+    // and matching traffic keeps a refreshed entry alive
+    if entry.TimeToLive > 0 {
+        now := time.Now()
+        if entry.Expired(now) {
+            return false
+        }
+
+        if entry.Refresh {
+            entry.refresh(now)
+        }
+    }
 
-    Print("Engine policies:")
+    return true
+}
 
-    for index, pol := range p.rules {
+// insert entry before index, or append it if index is negative
+func (p *Policy) Insert(index int, entry *PolicyEntry) (error) {
+    return p.InsertCompiled(index, entry.Name, func() (*PolicyEntry, error) {
+        return entry, nil
+    })
+}
 
-        output = "[" + strconv.Itoa(index) + "] "
+/* Insert the entry called name, built by compile once index and name are
+   known to be valid; both run under the mutex so an entry that cannot be
+   inserted is never compiled and creates no peer.
+*/
+func (p *Policy) InsertCompiled(index int, name string, compile func() (*PolicyEntry, error)) (error) {
+    return p.update(func(rules []*PolicyEntry) ([]*PolicyEntry, error) {
+        if index < 0 {
+            index = len(rules)
+        }
 
-        if pol.Match.srcSubnet != nil {
-            output = output + pol.Match.srcSubnet.String()
-        } else {
-            output = output + "*"
+        if index > len(rules) {
+            return nil, ErrPolicyIndexInvalid
         }
 
-        output = output + " "
+        if name != "" && indexOf(rules, name) >= 0 {
+            return nil, ErrPolicyDuplicate
+        }
 
-        if pol.Match.dstSubnet != nil {
-            output = output + pol.Match.dstSubnet.String()
-        } else {
-            output = output + "*"
+        entry, err := compile()
+        if err != nil {
+            return nil, err
         }
 
-        output = output + " ==> "
+        return append(rules[:index], append([]*PolicyEntry{entry}, rules[index:]...)...), nil
+    })
+}
+
+// run inspect on the current rules with the mutex held, so none are added meanwhile
+func (p *Policy) Inspect(inspect func([]*PolicyEntry)) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    inspect(p.snapshot())
+}
 
-        switch pol.Action.egress {
-        case NETIO_LOCAL   : output = output + "local "
-        case NETIO_TUNNEL  : output = output + "forward "
-        case NETIO_DROP    : output = output + "drop "
-        default            : output = output + "unknown "
+// remove the entry at index
+func (p *Policy) Delete(index int) (error) {
+    return p.update(func(rules []*PolicyEntry) ([]*PolicyEntry, error) {
+        if index < 0 || index >= len(rules) {
+            return nil, ErrPolicyIndexInvalid
         }
 
-        if pol.Action.endpoint != nil {
-            output = output + pol.Action.endpoint.String()
+        return append(rules[:index], rules[index+1:]...), nil
+    })
+}
+
+// remove the entry called name, found and removed in one step
+func (p *Policy) DeleteByName(name string) (error) {
+    return p.update(func(rules []*PolicyEntry) ([]*PolicyEntry, error) {
+        index := indexOf(rules, name)
+        if index < 0 {
+            return nil, ErrPolicyUnknownName
+        }
+
+        return append(rules[:index], rules[index+1:]...), nil
+    })
+}
+
+func indexOf(rules []*PolicyEntry, name string) int {
+    for index, entry := range rules {
+        if entry.Name == name {
+            return index
         }
+    }
 
-        if pol.TimeToLive != 0 {
-            output = " " + output + strconv.Itoa(pol.TimeToLive)
+    return -1
+}
+
+// move the entry at from so it ends up at index to
+func (p *Policy) Move(from int, to int) (error) {
+    return p.update(func(rules []*PolicyEntry) ([]*PolicyEntry, error) {
+        if from < 0 || from >= len(rules) || to < 0 || to >= len(rules) {
+            return nil, ErrPolicyIndexInvalid
+        }
+
+        entry := rules[from]
+        rules = append(rules[:from], rules[from+1:]...)
+        return append(rules[:to], append([]*PolicyEntry{entry}, rules[to:]...)...), nil
+    })
+}
+
+// replace every entry, a name used twice keeps its first entry
+func (p *Policy) Replace(rules []*PolicyEntry) {
+    names := make(map[string]bool)
+    unique := make([]*PolicyEntry, 0, len(rules))
+
+    for _, entry := range rules {
+        if entry.Name != "" && names[entry.Name] {
+            Log(ErrPolicyDuplicate)
+            Print("Policy entry dropped: " + entry.String())
+            continue
         }
 
-        log.Println(output)
+        names[entry.Name] = true
+        unique = append(unique, entry)
     }
+
+    p.update(func([]*PolicyEntry) ([]*PolicyEntry, error) {
+        return unique, nil
+    })
+}
+
+// remove the entries whose TTL has run out and return them
+func (p *Policy) Reap(now time.Time) []*PolicyEntry {
+    var expired []*PolicyEntry
+
+    // avoid publishing a new snapshot when nothing expired
+    found := false
+    for _, entry := range p.snapshot() {
+        found = found || entry.Expired(now)
+    }
+
+    if !found {
+        return nil
+    }
+
+    p.update(func(rules []*PolicyEntry) ([]*PolicyEntry, error) {
+        alive := rules[:0]
+        for _, entry := range rules {
+            if entry.Expired(now) {
+                expired = append(expired, entry)
+                continue
+            }
+
+            alive = append(alive, entry)
+        }
+
+        return alive, nil
+    })
+
+    return expired
+}
+
+// entries of every table in effective evaluation order, main table first
+func (p *Policy) Entries() []PolicyView {
+    current := p.rules.Load()
+    if current == nil {
+        return []PolicyView{}
+    }
+
+    position := make(map[*PolicyEntry]int)
+    for index, entry := range current.rules {
+        position[entry] = index
+    }
+
+    views := []PolicyView{}
+    for _, name := range current.tableNames() {
+        for _, entry := range current.tables[name].rules {
+            views = append(views, PolicyView{Index: position[entry], PolicyEntryFile: entry.Source})
+        }
+    }
+
+    return views
+}
+
+
+func (p *Policy) DumpPolicies() {
+    current := p.rules.Load()
+    if current == nil {
+        Print("Engine policies:")
+        return
+    }
+
+    if current.lpm {
+        Print("Engine policies (longest prefix match):")
+    } else {
+        Print("Engine policies:")
+    }
+
+    if current.fallback.reject != RejectNone {
+        log.Println("No match ==> reject " + rejectName(current.fallback.reject))
+    } else {
+        log.Println("No match ==> drop")
+    }
+
+    position := make(map[*PolicyEntry]int)
+    for index, entry := range current.rules {
+        position[entry] = index
+    }
+
+    for _, name := range current.tableNames() {
+        log.Println("Table " + name + ":")
+        for _, pol := range current.tables[name].rules {
+            log.Println("\t[" + strconv.Itoa(position[pol]) + "] " + pol.String())
+        }
+    }
+}
+
+func (pol *PolicyEntry) String() string {
+    var output string
+
+    if pol.Priority != 0 {
+        output = "prio " + strconv.Itoa(pol.Priority) + " "
+    }
+
+    if pol.Name != "" {
+        output = output + pol.Name + ": "
+    }
+
+    if pol.Match.srcSubnet != nil {
+        output = output + pol.Match.srcSubnet.String()
+    } else {
+        output = output + "*"
+    }
+
+    output = output + " "
+
+    if pol.Match.dstSubnet != nil {
+        output = output + pol.Match.dstSubnet.String()
+    } else {
+        output = output + "*"
+    }
+
+    if !pol.Match.transport.Any() {
+        output = output + " " + pol.Match.transport.String()
+    }
+
+    output = output + " ==> "
+
+    switch {
+    case pol.Action.jump != ""              : output = output + "jump " + pol.Action.jump + " "
+    case pol.Action.mirror                  : output = output + "mirror "
+    case pol.Action.reject != RejectNone    : output = output + "reject " + rejectName(pol.Action.reject) + " "
+    case pol.Action.egress == NETIO_LOCAL   : output = output + "local "
+    case pol.Action.egress == NETIO_TUNNEL  : output = output + "forward "
+    case pol.Action.egress == NETIO_DROP    : output = output + "drop "
+    default                                 : output = output + "unknown "
+    }
+
+    if pol.Action.group != nil {
+        output = output + pol.Action.group.String() + " "
+    } else if pol.Action.failover != nil {
+        output = output + pol.Action.failover.String() + " "
+    } else if pol.Action.peer != nil {
+        output = output + pol.Action.peer.String() + " "
+    } else if pol.Action.mirror {
+        output = output + "capture "
+    }
+
+    if pol.Action.transit {
+        output = output + "transit "
+    }
+
+    if pol.Action.mss != 0 {
+        output = output + "mss " + strconv.Itoa(int(pol.Action.mss)) + " "
+    }
+
+    if pol.TimeToLive != 0 {
+        output = output + "ttl " + strconv.Itoa(pol.TimeToLive) + "s"
+        if remaining := time.Until(time.Unix(0, pol.expires.Load())); remaining > 0 {
+            output = output + " (" + remaining.Round(time.Second).String() + " left)"
+        }
+    }
+
+    return strings.TrimSpace(output)
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "strconv"
+    "testing"
+)
+
+func testPacket(src string, dst string) *Packet {
+    pkt := &Packet{Data: make([]byte, IPv4HeaderSize), Size: IPv4HeaderSize}
+    pkt.Data[0] = 0x45
+    copy(pkt.Data[12:16], net.ParseIP(src).To4())
+    copy(pkt.Data[16:20], net.ParseIP(dst).To4())
+
+    return pkt
+}
+
+// IPv6 packet without extension headers, carrying payload as protocol
+func testPacket6(src string, dst string, protocol uint8, payload ...byte) *Packet {
+    pkt := &Packet{Data: make([]byte, IPv6HeaderSize, IPv6HeaderSize + len(payload))}
+    pkt.Data[0] = 0x60
+    binary.BigEndian.PutUint16(pkt.Data[4:6], uint16(len(payload)))
+    pkt.Data[6] = protocol
+    pkt.Data[7] = 64
+    copy(pkt.Data[8:24], net.ParseIP(src))
+    copy(pkt.Data[24:40], net.ParseIP(dst))
+    pkt.Data = append(pkt.Data, payload...)
+    pkt.Size = uint16(len(pkt.Data))
+
+    return pkt
+}
+
+func testPolicy(t testing.TB, lookup string, entries ...PolicyEntryFile) *Policy {
+    p := &Policy{}
+    if err := p.SetLookup(lookup); err != nil {
+        t.Fatal(err)
+    }
+
+    rules := []*PolicyEntry{}
+    for _, pol := range entries {
+        entry, err := CompileEntry(pol, &Peers{})
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        rules = append(rules, entry)
+    }
+    p.Replace(rules)
+
+    return p
+}
+
+func TestLookupLongestPrefix(t *testing.T) {
+    entries := []PolicyEntryFile{
+        {Action: "LOCAL"},
+        {DstSubnet: "10.0.0.0/8", Action: "DROP"},
+        {DstSubnet: "10.1.0.0/16", Action: "LOCAL"},
+        {DstSubnet: "10.1.0.0/16", SrcSubnet: "192.168.0.0/16", Action: "DROP"},
+    }
+
+    cases := []struct {
+        src, dst string
+        egress   uint8
+    }{
+        {"172.16.0.1", "8.8.8.8", NETIO_LOCAL},
+        {"172.16.0.1", "10.2.0.1", NETIO_DROP},
+        {"172.16.0.1", "10.1.0.1", NETIO_LOCAL},
+        {"192.168.1.1", "10.1.0.1", NETIO_DROP},
+    }
+
+    p := testPolicy(t, LookupLongestPrefix, entries...)
+    for _, c := range cases {
+        action, found := p.Lookup(testPacket(c.src, c.dst))
+        if !found || action.egress != c.egress {
+            t.Errorf("%s -> %s: got %d, %t, want %d", c.src, c.dst, action.egress, found, c.egress)
+        }
+    }
+
+    // first match keeps the catch-all in front
+    p = testPolicy(t, LookupFirstMatch, entries...)
+    if action, _ := p.Lookup(testPacket("172.16.0.1", "10.2.0.1")); action.egress != NETIO_LOCAL {
+        t.Errorf("first match: got %d, want %d", action.egress, NETIO_LOCAL)
+    }
+}
+
+func benchmarkLookup(b *testing.B, lookup string, routes int) {
+    entries := make([]PolicyEntryFile, 0, routes + 1)
+    for i := 0; i < routes; i++ {
+        entries = append(entries, PolicyEntryFile{
+            DstSubnet: "10." + strconv.Itoa(i >> 8 & 0xff) + "." + strconv.Itoa(i & 0xff) + ".0/24",
+            Action:    "DROP",
+        })
+    }
+    entries = append(entries, PolicyEntryFile{Action: "LOCAL"})
+
+    p := testPolicy(b, lookup, entries...)
+    packets := []*Packet{
+        testPacket("172.16.0.1", "10.0.0.1"),
+        testPacket("172.16.0.1", "10." + strconv.Itoa((routes - 1) >> 8 & 0xff) + "." + strconv.Itoa((routes - 1) & 0xff) + ".1"),
+        testPacket("172.16.0.1", "8.8.8.8"),
+    }
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        p.Lookup(packets[i % len(packets)])
+    }
+}
+
+func BenchmarkLookupFirstMatch1k(b *testing.B)      { benchmarkLookup(b, LookupFirstMatch, 1000) }
+func BenchmarkLookupFirstMatch50k(b *testing.B)     { benchmarkLookup(b, LookupFirstMatch, 50000) }
+func BenchmarkLookupLongestPrefix1k(b *testing.B)   { benchmarkLookup(b, LookupLongestPrefix, 1000) }
+func BenchmarkLookupLongestPrefix50k(b *testing.B)  { benchmarkLookup(b, LookupLongestPrefix, 50000) }
+
+func TestLookupTransport(t *testing.T) {
+    dscp := 46
+    p := testPolicy(t, LookupFirstMatch,
+        PolicyEntryFile{Protocol: "tcp", DstPort: "22", Action: "LOCAL"},
+        PolicyEntryFile{Protocol: "udp", SrcPort: "1000-2000", DSCP: &dscp, Action: "LOCAL"},
+        PolicyEntryFile{Action: "DROP"},
+    )
+
+    packet := func(protocol uint8, tos uint8, sport uint16, dport uint16) *Packet {
+        pkt := testPacket("10.0.0.1", "10.0.0.2")
+        pkt.Data = append(pkt.Data, byte(sport >> 8), byte(sport), byte(dport >> 8), byte(dport))
+        pkt.Size = uint16(len(pkt.Data))
+        pkt.Data[1] = tos
+        pkt.Data[9] = protocol
+        return pkt
+    }
+
+    cases := []struct {
+        pkt     *Packet
+        egress  uint8
+    }{
+        {packet(6, 0, 40000, 22), NETIO_LOCAL},
+        {packet(6, 0, 40000, 23), NETIO_DROP},
+        {packet(17, 46 << 2, 1500, 53), NETIO_LOCAL},
+        {packet(17, 0, 1500, 53), NETIO_DROP},
+        {packet(17, 46 << 2, 2001, 53), NETIO_DROP},
+    }
+
+    for index, c := range cases {
+        if action, _ := p.Lookup(c.pkt); action.egress != c.egress {
+            t.Errorf("case %d: got %d, want %d", index, action.egress, c.egress)
+        }
+    }
+}
+
+func TestLookupIPv6(t *testing.T) {
+    entries := []PolicyEntryFile{
+        {Action: "DROP"},
+        {DstSubnet: "10.0.0.0/8", Action: "LOCAL"},
+        {DstSubnet: "fd00::/8", Action: "LOCAL"},
+        {DstSubnet: "fd00:1::/32", Action: "DROP"},
+        {DstSubnet: "fd00:1::/32", SrcSubnet: "fd00:2::/32", Action: "LOCAL"},
+        {DstSubnet: "fd00:3::/32", Protocol: "udp", DstPort: "53", Action: "LOCAL"},
+        {DstSubnet: "fd00:3::/32", Protocol: "tcp", SrcPort: "1000-2000", Action: "LOCAL"},
+        {DstSubnet: "fd00:3::/32", Action: "DROP"},
+    }
+
+    cases := []struct {
+        pkt     *Packet
+        egress  uint8
+    }{
+        {testPacket6("fd00:9::1", "fd00:9::2", 17), NETIO_LOCAL},
+        {testPacket6("fd00:9::1", "fd00:1::2", 17), NETIO_DROP},
+        {testPacket6("fd00:2::1", "fd00:1::2", 17), NETIO_LOCAL},
+        {testPacket6("fd00:9::1", "2001:db8::1", 17), NETIO_DROP},
+        // a v4-mapped address does not match IPv4 subnets
+        {testPacket6("fd00:9::1", "::ffff:10.0.0.1", 17), NETIO_DROP},
+        {testPacket6("fd00:9::1", "fd00:3::1", 17, 0x9c, 0x40, 0, 53), NETIO_LOCAL},
+        {testPacket6("fd00:9::1", "fd00:3::1", 6, 0x9c, 0x40, 0, 53), NETIO_DROP},
+        {testPacket6("fd00:9::1", "fd00:3::1", 6, 0x05, 0xdc, 0, 80), NETIO_LOCAL},
+        {testPacket6("fd00:9::1", "fd00:3::1", 6, 0x0b, 0xb8, 0, 80), NETIO_DROP},
+        // ports are not read past an extension header
+        {testPacket6("fd00:9::1", "fd00:3::1", 0, 0, 53), NETIO_DROP},
+    }
+
+    p := testPolicy(t, LookupLongestPrefix, entries...)
+    for index, c := range cases {
+        if action, found := p.Lookup(c.pkt); !found || action.egress != c.egress {
+            t.Errorf("case %d: got %d, %t, want %d", index, action.egress, found, c.egress)
+        }
+    }
+}
+
+func TestLookupPriorityAndTables(t *testing.T) {
+    entries := []PolicyEntryFile{
+        {Name: "default", Priority: 100, Action: "DROP"},
+        {Name: "office", DstSubnet: "10.0.0.0/8", Action: "JUMP", Target: "office"},
+        {Table: "office", DstSubnet: "10.1.0.0/16", Action: "LOCAL"},
+        {Table: "office", Priority: -1, SrcSubnet: "192.168.0.0/16", Action: "DROP"},
+        {Name: "loop", Table: "loop", Action: "JUMP", Target: "loop"},
+        {DstSubnet: "172.16.0.0/12", Action: "JUMP", Target: "loop"},
+    }
+
+    cases := []struct {
+        src, dst string
+        egress   uint8
+    }{
+        {"172.16.0.1", "10.1.0.1", NETIO_LOCAL},
+        {"192.168.1.1", "10.1.0.1", NETIO_DROP},
+        // nothing matches in the office table, evaluation continues in main
+        {"172.16.0.1", "10.2.0.1", NETIO_DROP},
+        // a jump cycle ends once the jump limit is reached
+        {"10.0.0.1", "172.16.0.1", NETIO_DROP},
+    }
+
+    for _, lookup := range []string{LookupFirstMatch, LookupLongestPrefix} {
+        p := testPolicy(t, lookup, entries...)
+        for _, c := range cases {
+            action, found := p.Lookup(testPacket(c.src, c.dst))
+            if !found || action.egress != c.egress {
+                t.Errorf("%s %s -> %s: got %d, %t, want %d", lookup, c.src, c.dst, action.egress, found, c.egress)
+            }
+        }
+
+        // the entries are reported main table first, in priority order
+        views := p.Entries()
+        if len(views) != len(entries) || views[0].Name != "office" || views[len(views) - 1].Index != 2 {
+            t.Errorf("%s: unexpected order %v", lookup, views)
+        }
+
+        if err := p.Insert(-1, &PolicyEntry{Name: "default", Table: PolicyMainTable}); err != ErrPolicyDuplicate {
+            t.Errorf("%s: duplicate name: got %v", lookup, err)
+        }
+    }
+}
+
+func TestLookupMirrors(t *testing.T) {
+    p := testPolicy(t, LookupFirstMatch,
+        PolicyEntryFile{DstSubnet: "10.0.0.0/8", Action: "MIRROR"},
+        PolicyEntryFile{DstSubnet: "10.1.0.0/16", Action: "JUMP", Target: "tap"},
+        PolicyEntryFile{Table: "tap", Action: "MIRROR"},
+        PolicyEntryFile{Action: "LOCAL"},
+    )
+
+    mirrors := []PolicyAction{}
+    action, found := p.LookupMirrors(testPacket("172.16.0.1", "10.1.0.1"), &mirrors)
+    if !found || action.egress != NETIO_LOCAL || len(mirrors) != 2 || mirrors[0].egress != NETIO_CAPTURE {
+        t.Errorf("got %d, %t with mirrors %v", action.egress, found, mirrors)
+    }
+
+    mirrors = mirrors[:0]
+    if p.LookupMirrors(testPacket("172.16.0.1", "192.168.0.1"), &mirrors); len(mirrors) != 0 {
+        t.Errorf("unexpected mirrors %v", mirrors)
+    }
+}
+
+func TestForwardedSubnets(t *testing.T) {
+    peers, _ := testPeers(t)
+
+    rules := []*PolicyEntry{}
+    for _, pol := range []PolicyEntryFile{
+        {DstSubnet: "10.1.0.0/16", Action: "FORWARD", Peer: "b"},
+        {DstSubnet: "127.0.0.0/8", Action: "FORWARD", Peer: "b"},
+        {Action: "FORWARD", Peer: "b"},
+        {DstSubnet: "10.2.0.0/16", Action: "JUMP", Target: "branch"},
+        {Table: "branch", DstSubnet: "10.2.1.0/24", Action: "FORWARD", Peer: "b"},
+        {Table: "orphan", DstSubnet: "10.3.0.0/16", Action: "FORWARD", Peer: "b"},
+        {DstSubnet: "10.4.0.0/16", Action: "MIRROR"},
+    } {
+        entry, err := CompileEntry(pol, peers)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        rules = append(rules, entry)
+    }
+
+    p := &Policy{}
+    p.Replace(rules)
+
+    subnets, skipped := p.rules.Load().forwardedSubnets(peers.Endpoints())
+
+    // the default route and the orphan table are left out, the prefix holding the endpoint skipped
+    if len(subnets) != 2 || subnets[0].String() != "10.1.0.0/16" || subnets[1].String() != "10.2.1.0/24" {
+        t.Errorf("got routes %v", subnets)
+    }
+
+    if len(skipped) != 1 || skipped[0].String() != "127.0.0.0/8" {
+        t.Errorf("got skipped %v", skipped)
+    }
+}
+
+func TestInsertCreatesNoPeerOnFailure(t *testing.T) {
+    key, public, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    peers := &Peers{}
+    if err = peers.Init(key, public, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    p := testPolicy(t, LookupFirstMatch, PolicyEntryFile{Name: "local", Action: "LOCAL"})
+    forward := PolicyEntryFile{Action: "FORWARD", Endpoint: "192.0.2.1:9000"}
+
+    err = p.InsertCompiled(5, "", func() (*PolicyEntry, error) { return CompileEntry(forward, peers) })
+    if err != ErrPolicyIndexInvalid {
+        t.Fatalf("bad index: %v", err)
+    }
+
+    // entries failing after their endpoint is resolved do not keep its peer either
+    for _, pol := range []PolicyEntryFile{
+        {Action: "FORWARD", Endpoint: "192.0.2.1:9000", MSS: 100},
+        {Action: "FORWARD", Endpoint: "192.0.2.1:9000", NextHops: []NextHopFile{{Peer: "unknown"}}},
+        {Action: "FORWARD", Endpoint: "192.0.2.1:9000", Backup: "unknown"},
+    } {
+        if _, err = CompileEntry(pol, peers); err == nil {
+            t.Fatalf("%v compiled", pol)
+        }
+    }
+
+    if len(peers.List()) != 0 {
+        t.Fatalf("peers created: %d", len(peers.List()))
+    }
+
+    if err = p.InsertCompiled(0, "", func() (*PolicyEntry, error) { return CompileEntry(forward, peers) }); err != nil {
+        t.Fatal(err)
+    }
+
+    if len(peers.List()) != 1 || len(p.snapshot()) != 2 {
+        t.Fatalf("%d peers, %d entries", len(peers.List()), len(p.snapshot()))
+    }
+
+    if err = p.DeleteByName("local"); err != nil || p.DeleteByName("local") != ErrPolicyUnknownName {
+        t.Fatalf("delete by name: %v", err)
+    }
+}
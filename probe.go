@@ -0,0 +1,157 @@
+// liveness probing of peers and primary/backup failover
+package main
+
+import (
+    "errors"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    ProbeInterval   = time.Second
+    ProbeMisses     = 3     // probes missed in a row before a peer fails
+    ProbeRecover    = 5     // probes answered in a row before it recovers
+)
+
+var ErrFailoverAction = errors.New("Backup needs the FORWARD action and a peer")
+
+/* Probe state of a monitored peer, held under the peer mutex.
+   A probe still unanswered when the next one is due counts as missed.
+   The peer fails after Misses probes missed in a row and only recovers
+   after Recover probes answered in a row, so a flapping path does not
+   move traffic back and forth.
+*/
+type Liveness struct {
+    sequence    uint64
+    answered    bool
+    missed      int
+    answers     int
+    failed      bool
+    sent        uint32
+    received    uint32
+}
+
+type probeSettings struct {
+    interval    time.Duration
+    misses      int
+    recover     int
+}
+
+// probe settings from the configuration, with the defaults for unset values
+func compileProbe(conf ProbeFile) probeSettings {
+    settings := probeSettings{interval: ProbeInterval, misses: ProbeMisses, recover: ProbeRecover}
+
+    if conf.Interval > 0 {
+        settings.interval = time.Duration(conf.Interval) * time.Second
+    }
+
+    if conf.Misses > 0 {
+        settings.misses = conf.Misses
+    }
+
+    if conf.Recover > 0 {
+        settings.recover = conf.Recover
+    }
+
+    return settings
+}
+
+// account for the previous probe and return the sequence of the next one
+// with the number of probes missed in a row; changed reports that the peer just failed
+func (p *Peer) nextProbe(misses int) (sequence uint64, missed int, changed bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    live := &p.liveness
+    if live.sent > 0 && !live.answered {
+        live.missed++
+        live.answers = 0
+
+        if !live.failed && live.missed >= misses {
+            live.failed = true
+            changed = true
+        }
+    }
+
+    live.sequence++
+    live.answered = false
+    live.sent++
+
+    return live.sequence, live.missed, changed
+}
+
+// record the reply to a probe; changed reports that the peer just recovered
+func (p *Peer) probeAnswered(sequence uint64, recover int) (changed bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    live := &p.liveness
+    if sequence != live.sequence || live.answered {
+        return false
+    }
+
+    live.answered = true
+    live.received++
+    live.missed = 0
+    live.answers++
+
+    if live.failed && live.answers >= recover {
+        live.failed = false
+        return true
+    }
+
+    return false
+}
+
+// traffic of a FORWARD entry with a backup, moved between the two by Update
+type Failover struct {
+    primary *Peer
+    backup  *Peer
+    active  atomic.Pointer[Peer]
+}
+
+func NewFailover(primary *Peer, backup *Peer) *Failover {
+    f := &Failover{primary: primary, backup: backup}
+    f.active.Store(primary)
+
+    return f
+}
+
+func (f *Failover) Active() *Peer {
+    return f.active.Load()
+}
+
+// switch to the backup when the primary is down and the backup is not,
+// and back as soon as the primary is up; returns the new peer on a switch
+func (f *Failover) Update() (*Peer, bool) {
+    active := f.active.Load()
+
+    next := active
+    switch {
+    case active == f.primary && f.primary.Down() && !f.backup.Down():
+        next = f.backup
+    case active == f.backup && !f.primary.Down():
+        next = f.primary
+    }
+
+    if next == active {
+        return active, false
+    }
+
+    f.active.Store(next)
+    return next, true
+}
+
+func (f *Failover) String() string {
+    output := f.primary.String() + " backup " + f.backup.String()
+    if f.Active() == f.backup {
+        output = output + " (active)"
+    }
+
+    return output
+}
+
+func (l *Liveness) String() string {
+    return strconv.Itoa(int(l.received)) + "/" + strconv.Itoa(int(l.sent)) + " probes answered"
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestFailover(t *testing.T) {
+    primary, backup := &Peer{name: "primary"}, &Peer{name: "backup"}
+    f := NewFailover(primary, backup)
+
+    probe := func(peer *Peer, answer bool) (failed bool, recovered bool) {
+        sequence, _, failed := peer.nextProbe(3)
+        if answer {
+            recovered = peer.probeAnswered(sequence, 2)
+        }
+
+        return failed, recovered
+    }
+
+    // two misses are tolerated, the third fails the primary
+    for round, answer := range []bool{false, false, false, false} {
+        probe(backup, true)
+        failed, _ := probe(primary, answer)
+        if failed != (round == 3) {
+            t.Fatalf("round %d: failed %t", round, failed)
+        }
+    }
+
+    if active, switched := f.Update(); !switched || active != backup {
+        t.Fatalf("no failover to backup")
+    }
+
+    // a single answer is not enough to come back
+    probe(primary, false)
+    if _, recovered := probe(primary, true); recovered || f.Active() != backup {
+        t.Fatalf("failback after one answer")
+    }
+
+    if _, switched := f.Update(); switched {
+        t.Fatalf("failback before recovery")
+    }
+
+    if _, recovered := probe(primary, true); !recovered {
+        t.Fatalf("primary did not recover")
+    }
+
+    if active, switched := f.Update(); !switched || active != primary {
+        t.Fatalf("no failback to primary")
+    }
+
+    // a backup that is down is not used
+    backup.liveness.failed = true
+    primary.liveness.failed = true
+    if _, switched := f.Update(); switched {
+        t.Fatalf("failover to a backup that is down")
+    }
+}
+
+func TestProbeWithoutEndpoint(t *testing.T) {
+    tunnel := &UDPSocket{ProbeMisses: 3}
+    peer := &Peer{name: "unknown"}
+
+    // the probes are missed quietly until the peer fails, once
+    for round := 0; round < 6; round++ {
+        failed, err := tunnel.SendProbe(peer)
+        if err != nil || failed != (round == 3) {
+            t.Fatalf("round %d: failed %t, %v", round, failed, err)
+        }
+    }
+}
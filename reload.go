@@ -0,0 +1,262 @@
+// live configuration reload
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "strconv"
+)
+
+/* Re-read the configuration file and apply the difference with the running one
+   1 - Settings that need a new socket, device or identity are logged and kept
+   2 - Peers are added, removed or updated in place, keeping their sessions;
+       an invalid peer, or IPv6 under an MTU too small for it, aborts the
+       reload before anything is applied
+   3 - The control server is moved to a new address, the lookup mode and the
+       default action switched, and the capture file reopened; a change that
+       fails is logged and the running value kept
+   4 - Policy entries from the file are diffed against the running ones;
+       unchanged entries are kept as they are, and entries added at
+       runtime through the control API are kept after the file entries
+*/
+func (e *Engine) Reload() (error) {
+    var added, removed, changed []string
+    var err error
+
+    e.reload.Lock()
+    defer e.reload.Unlock()
+
+    conf := Configuration{Filename: e.conf.Filename}
+    if err = conf.ReadJSON(); err != nil {
+        return ErrInConfigFile
+    }
+
+    running := &e.conf.content
+    next := &conf.content
+
+    if next.Name != running.Name {
+        Print("Reload: interface name change to " + next.Name + " requires a restart")
+        next.Name = running.Name
+    }
+
+    if next.Data != running.Data {
+        Print("Reload: data socket change to " + next.Data + " requires a restart")
+        next.Data = running.Data
+    }
+
+    if next.Address != running.Address {
+        Print("Reload: address change to " + next.Address + " requires a restart")
+        next.Address = running.Address
+    }
+
+    if next.MTU != running.MTU || next.PMTUD != running.PMTUD {
+        Print("Reload: MTU settings change requires a restart")
+        next.MTU, next.PMTUD = running.MTU, running.PMTUD
+    }
+
+    // the forwarding loops read the hop limit without locking
+    if next.MaxHops != running.MaxHops {
+        Print("Reload: max_hops change to " + strconv.Itoa(next.MaxHops) + " requires a restart")
+        next.MaxHops = running.MaxHops
+    }
+
+    if next.PathID != running.PathID {
+        Print("Reload: path_id change to " + strconv.Itoa(next.PathID) + " requires a restart")
+        next.PathID = running.PathID
+    }
+
+    if next.Probe != running.Probe {
+        Print("Reload: probe settings change requires a restart")
+        next.Probe = running.Probe
+    }
+
+    if next.Rendezvous != running.Rendezvous {
+        Print("Reload: rendezvous change requires a restart")
+        next.Rendezvous = running.Rendezvous
+    }
+
+    if next.Key != running.Key || next.Pubkey != running.Pubkey {
+        Print("Reload: key change requires a restart")
+        next.Key, next.Pubkey = running.Key, running.Pubkey
+    }
+
+    if err = checkMTU(e.mtu, next); err != nil {
+        return err
+    }
+
+    // every peer is compiled before any is applied, so a bad entry leaves
+    // the running configuration untouched
+    if added, removed, changed, err = e.peers.Reload(next.Peers); err != nil {
+        return err
+    }
+
+    for _, name := range added {
+        Print("Reload: peer added " + name)
+    }
+
+    for _, name := range removed {
+        Print("Reload: peer removed " + name)
+    }
+
+    for _, name := range changed {
+        Print("Reload: peer changed " + name)
+    }
+
+    if next.Control != running.Control {
+        if err = e.moveControl(next.Control); err != nil {
+            Print("Reload: cannot move control server to " + next.Control + ": " + err.Error())
+            next.Control = running.Control
+        }
+    }
+
+    if next.Lookup != running.Lookup {
+        if err = e.rules.SetLookup(next.Lookup); err != nil {
+            Print("Reload: " + err.Error() + " " + next.Lookup)
+            next.Lookup = running.Lookup
+        } else {
+            Print("Reload: policy lookup changed to " + next.Lookup)
+        }
+    }
+
+    if next.Default != running.Default {
+        if err = e.rules.SetDefault(next.Default); err != nil {
+            Print("Reload: " + err.Error())
+            next.Default = running.Default
+        } else {
+            Print("Reload: default action changed to " + next.Default)
+        }
+    }
+
+    if next.Capture != running.Capture {
+        if err = e.ports[NETIO_CAPTURE].netio.(*Capture).Reopen(next.Capture); err != nil {
+            Print("Reload: " + err.Error())
+            next.Capture = running.Capture
+        } else {
+            Print("Reload: capture file changed to " + next.Capture)
+        }
+    }
+
+    e.reloadPolicies(running.Policies, next.Policies)
+
+    e.conf.content = conf.content
+    Print("Configuration reloaded")
+
+    return nil
+}
+
+// entries are identified by their configuration
+func policyKey(pol PolicyEntryFile) string {
+    key, _ := json.Marshal(pol)
+    return string(key)
+}
+
+func (e *Engine) reloadPolicies(previous []PolicyEntryFile, policies []PolicyEntryFile) {
+    var entry *PolicyEntry
+    var err error
+    var added, kept int
+
+    // running entries that came from the previous file, by configuration
+    fromFile := make(map[string]int)
+    for _, pol := range previous {
+        fromFile[policyKey(pol)]++
+    }
+
+    reusable := make(map[string][]*PolicyEntry)
+    runtime := []*PolicyEntry{}
+
+    for _, entry := range e.rules.snapshot() {
+        key := policyKey(entry.Source)
+        if fromFile[key] > 0 {
+            fromFile[key]--
+            reusable[key] = append(reusable[key], entry)
+        } else {
+            runtime = append(runtime, entry)
+        }
+    }
+
+    rules := []*PolicyEntry{}
+    for _, pol := range policies {
+        key := policyKey(pol)
+
+        // keep the running entry while it still points at a configured peer
+        if candidates := reusable[key]; len(candidates) > 0 && e.validPeer(candidates[0]) && e.validCapture(candidates[0]) {
+            rules = append(rules, candidates[0])
+            reusable[key] = candidates[1:]
+            kept++
+            continue
+        }
+
+        if entry, err = e.compileEntry(pol); err != nil {
+            Log(err)
+            continue
+        }
+
+        rules = append(rules, entry)
+        added++
+    }
+
+    for _, entry := range runtime {
+        if !e.validPeer(entry) {
+            Print("Reload: runtime policy entry dropped, peer removed: " + entry.String())
+            continue
+        }
+
+        if !e.validCapture(entry) {
+            Print("Reload: runtime policy entry dropped, capture disabled: " + entry.String())
+            continue
+        }
+
+        rules = append(rules, entry)
+    }
+
+    e.rules.Replace(rules)
+
+    removed := 0
+    for _, candidates := range reusable {
+        removed += len(candidates)
+    }
+
+    Print("Reload: policy entries kept " + strconv.Itoa(kept) + ", added " + strconv.Itoa(added) +
+        ", removed " + strconv.Itoa(removed))
+}
+
+// the peers of an entry must still be the ones known by their names
+func (e *Engine) validPeer(entry *PolicyEntry) bool {
+    for _, peer := range entry.peers() {
+        if peer != nil && !peer.anonymous && e.peers.ByName(peer.name) != peer {
+            return false
+        }
+    }
+
+    return true
+}
+
+// a mirror to the capture port needs the capture file still open
+func (e *Engine) validCapture(entry *PolicyEntry) bool {
+    return entry.Action.egress != NETIO_CAPTURE || e.capturing()
+}
+
+// start the control server on a new address before stopping the old one
+func (e *Engine) moveControl(address string) (error) {
+    old := e.control.server
+
+    if address != "" {
+        control := ControlServer{Address: address, engine: e}
+        if err := control.Init(); err != nil {
+            return err
+        }
+
+        e.control.server = control.server
+    } else {
+        e.control.server = nil
+    }
+
+    e.control.Address = address
+
+    // the request asking for the reload may still be served by the old server
+    if old != nil {
+        go old.Shutdown(context.Background())
+    }
+
+    return nil
+}
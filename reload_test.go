@@ -0,0 +1,130 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func TestReload(t *testing.T) {
+    keys := make([]string, 4)
+    for index := range keys {
+        _, public, err := GenerateKeyPair()
+        if err != nil {
+            t.Fatal(err)
+        }
+        keys[index] = public
+    }
+
+    key, _, err := GenerateKeyPair()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    running := EngineConfiguration{
+        Key:    key,
+        Lookup: LookupLongestPrefix,
+        MTU:    1400,
+        Peers: []PeerEntryFile{
+            {Name: "a", Pubkey: keys[0], Endpoint: "127.0.0.1:1", Allowed: []string{"10.1.0.0/16"}},
+            {Name: "b", Pubkey: keys[1], Endpoint: "127.0.0.1:2", Allowed: []string{"10.2.0.0/16"}},
+            {Name: "c", Pubkey: keys[2], Endpoint: "127.0.0.1:3", Allowed: []string{"10.3.0.0/16"}},
+        },
+        Policies: []PolicyEntryFile{
+            {DstSubnet: "10.1.0.0/16", Action: "FORWARD", Peer: "a"},
+            {DstSubnet: "10.2.0.0/16", Action: "FORWARD", Peer: "b"},
+            {DstSubnet: "10.3.0.0/16", Action: "FORWARD", Peer: "c"},
+            {DstSubnet: "10.9.0.0/16", Action: "LOCAL"},
+        },
+    }
+
+    e := &Engine{mtu: running.MTU, conf: Configuration{Filename: filepath.Join(t.TempDir(), "config.json"), content: running}}
+    if err = e.peers.Init(running.Key, running.Pubkey, running.Peers); err != nil {
+        t.Fatal(err)
+    }
+    if err = e.rules.SetLookup(running.Lookup); err != nil {
+        t.Fatal(err)
+    }
+
+    rules := []*PolicyEntry{}
+    for _, pol := range running.Policies {
+        entry, err := e.compileEntry(pol)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rules = append(rules, entry)
+    }
+    e.rules.Replace(rules)
+
+    // entries added through the control API survive only while their peer does
+    for _, pol := range []PolicyEntryFile{
+        {Name: "runtime-a", DstSubnet: "10.10.0.0/16", Action: "FORWARD", Peer: "a"},
+        {Name: "runtime-c", DstSubnet: "10.30.0.0/16", Action: "FORWARD", Peer: "c"},
+    } {
+        if err = e.rules.InsertCompiled(len(e.rules.snapshot()), pol.Name, func() (*PolicyEntry, error) { return e.compileEntry(pol) }); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    a, b := e.peers.ByName("a"), e.peers.ByName("b")
+    first := e.rules.snapshot()[0]
+
+    // a gets a new allowed subnet, b a new key, c is removed and d added
+    next := running
+    next.MTU = 1500
+    next.Peers = []PeerEntryFile{
+        {Name: "a", Pubkey: keys[0], Endpoint: "127.0.0.1:1", Allowed: []string{"10.1.0.0/16", "10.10.0.0/16"}},
+        {Name: "b", Pubkey: keys[3], Endpoint: "127.0.0.1:2", Allowed: []string{"10.2.0.0/16"}},
+        {Name: "d", Pubkey: keys[2], Endpoint: "127.0.0.1:4", Allowed: []string{"10.4.0.0/16"}},
+    }
+    next.Policies = []PolicyEntryFile{
+        {DstSubnet: "10.1.0.0/16", Action: "FORWARD", Peer: "a"},
+        {DstSubnet: "10.2.0.0/16", Action: "FORWARD", Peer: "b"},
+        {DstSubnet: "10.4.0.0/16", Action: "FORWARD", Peer: "d"},
+    }
+
+    content, err := json.Marshal(&next)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = ioutil.WriteFile(e.conf.Filename, content, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    if err = e.Reload(); err != nil {
+        t.Fatal(err)
+    }
+
+    if e.peers.ByName("a") != a || !a.Allows(testPacket("10.10.0.1", "10.1.0.1").GetSource()) {
+        t.Fatal("peer a not updated in place")
+    }
+
+    if e.peers.ByName("b") == b || e.peers.ByName("c") != nil || e.peers.ByName("d") == nil {
+        t.Fatal("peers b, c and d not replaced, removed and added")
+    }
+
+    entries := e.rules.snapshot()
+    if len(entries) != 4 {
+        t.Fatalf("%d policy entries: %v", len(entries), entries)
+    }
+
+    if entries[0] != first {
+        t.Fatal("unchanged policy entry recompiled")
+    }
+
+    for index, peer := range []*Peer{a, e.peers.ByName("b"), e.peers.ByName("d"), a} {
+        if entries[index].Action.peer != peer {
+            t.Fatalf("entry %d sends to %v, want %v", index, entries[index].Action.peer, peer)
+        }
+    }
+
+    if entries[3].Source.Name != "runtime-a" {
+        t.Fatalf("runtime entry kept: %v", entries[3])
+    }
+
+    // settings needing a restart keep their running value
+    if e.conf.content.MTU != 1400 {
+        t.Fatalf("MTU changed to %d", e.conf.content.MTU)
+    }
+}
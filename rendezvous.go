@@ -0,0 +1,116 @@
+// NAT traversal through a rendezvous node
+package main
+
+import (
+    "crypto/ecdh"
+    "time"
+)
+
+const (
+    PunchInterval      = RekeyTimeout
+)
+
+/* A publicly reachable node with "rendezvous" set answers, inside the
+   tunnel, with the endpoint it has learned for a peer key. Two nodes behind
+   NAT each keep a session with it through persistent keepalives, so it
+   knows their public mappings. A peer configured with the name of such a
+   node as its rendezvous has its endpoint looked up there while there is no
+   session, and handshakes are sent to it from both sides until one gets
+   through the NATs. Until then, traffic goes through the relay of the peer,
+   if any.
+   Lookups and answers are sealed probes, so only peers holding a session
+   with the rendezvous node can ask, and answers are only taken from the
+   node configured as rendezvous of the peer looked up.
+*/
+
+// ask the rendezvous peers for the endpoints of peers without a session
+func (e *Engine) punchHoles() {
+    ticker := time.NewTicker(PunchInterval)
+    defer ticker.Stop()
+
+    tunnel := e.ports[NETIO_TUNNEL].netio.(*UDPSocket)
+
+    for {
+        select {
+        case <-e.ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        for _, peer := range e.peers.List() {
+            peer.mutex.RLock()
+            rendezvous, connected := peer.rendezvous, peer.current != nil
+            peer.mutex.RUnlock()
+
+            if rendezvous == "" || rendezvous == peer.name || connected {
+                continue
+            }
+
+            node := e.peers.ByName(rendezvous)
+            if node == nil {
+                continue
+            }
+
+            if session := node.Session(); session != nil {
+                Log(tunnel.writeProbe(session, ProbeRendezvousRequest, 0, peer.remote.Bytes(), 0))
+            }
+        }
+    }
+}
+
+// answer a lookup for the peer with the key in body, on rendezvous nodes only
+func (t *UDPSocket) handleRendezvousRequest(session *Session, sequence uint64, body []byte) {
+    if !t.Rendezvous || len(body) < KeySize {
+        return
+    }
+
+    key, err := ecdh.X25519().NewPublicKey(body[:KeySize])
+    if err != nil {
+        return
+    }
+
+    peer := t.Peers.ByKey(key)
+    if peer == nil || peer.anonymous || peer == session.peer {
+        return
+    }
+
+    endpoint := peer.Endpoint()
+    if endpoint == nil {
+        return
+    }
+
+    Log(t.writeProbe(session, ProbeRendezvousReply, sequence, appendEndpoint(key.Bytes(), endpoint), 0))
+}
+
+// take the endpoint answered by the rendezvous node of a peer and punch towards it
+func (t *UDPSocket) handleRendezvousReply(session *Session, body []byte) {
+    if len(body) < KeySize + EndpointSize {
+        return
+    }
+
+    key, err := ecdh.X25519().NewPublicKey(body[:KeySize])
+    if err != nil {
+        return
+    }
+
+    peer := t.Peers.ByKey(key)
+    if peer == nil || peer.anonymous {
+        return
+    }
+
+    peer.mutex.RLock()
+    rendezvous := peer.rendezvous
+    peer.mutex.RUnlock()
+
+    // only the node configured as rendezvous of the peer is listened to
+    if rendezvous != session.peer.name {
+        return
+    }
+
+    endpoint := parseEndpoint(body[KeySize:])
+    if peer.SetEndpoint(endpoint) {
+        Print("Peer " + peer.name + " endpoint " + endpoint.String() + " from rendezvous " + rendezvous)
+    }
+
+    Log(t.Punch(peer))
+}
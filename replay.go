@@ -0,0 +1,58 @@
+// sliding window protection against replayed tunnel packets
+package main
+
+import (
+    "errors"
+)
+
+const (
+    ReplayWindowSize    = 2048
+    replayBlockBits     = 64
+    replayBlocks        = ReplayWindowSize / replayBlockBits
+)
+
+var (
+    ErrTunnelReplay = errors.New("Replayed or too old tunnel packet")
+)
+
+/* Bitmap of the counters seen below the highest one, as in RFC 6479.
+   The window advances a whole block at a time, so up to
+   ReplayWindowSize - 64 counters behind the highest are accepted.
+   Only the tunnel receive loop uses it, so it needs no locking.
+*/
+type ReplayWindow struct {
+    last    uint64
+    bitmap  [replayBlocks]uint64
+}
+
+// check counter against the window and record it if accepted;
+// only call this once the packet carrying counter has been authenticated
+func (w *ReplayWindow) Accept(counter uint64) bool {
+    block := counter / replayBlockBits
+
+    if counter > w.last {
+        current := w.last / replayBlockBits
+        diff := block - current
+        if diff > replayBlocks {
+            diff = replayBlocks
+        }
+
+        for i := uint64(1); i <= diff; i++ {
+            w.bitmap[(current + i) % replayBlocks] = 0
+        }
+
+        w.last = counter
+    } else if w.last - counter >= ReplayWindowSize - replayBlockBits {
+        return false
+    }
+
+    index := block % replayBlocks
+    bit := uint64(1) << (counter % replayBlockBits)
+
+    if w.bitmap[index] & bit != 0 {
+        return false
+    }
+
+    w.bitmap[index] |= bit
+    return true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+    cases := []struct {
+        name     string
+        counters []uint64
+        accepted []bool
+    }{
+        {"in order", []uint64{0, 1, 2, 3}, []bool{true, true, true, true}},
+        {"duplicate", []uint64{0, 1, 1, 0}, []bool{true, true, false, false}},
+        {"reordered", []uint64{5, 3, 4, 3}, []bool{true, true, true, false}},
+        {"gap", []uint64{0, 100, 50, 100}, []bool{true, true, true, false}},
+        {"out of window", []uint64{ReplayWindowSize * 2, ReplayWindowSize * 2 - (ReplayWindowSize - replayBlockBits)},
+            []bool{true, false}},
+        {"edge of window", []uint64{ReplayWindowSize * 2, ReplayWindowSize * 2 - (ReplayWindowSize - replayBlockBits) + 1},
+            []bool{true, true}},
+        // a jump past the whole window clears the blocks reused for new counters
+        {"advance", []uint64{1, ReplayWindowSize * 4 + 1, ReplayWindowSize * 4 + 2, 1},
+            []bool{true, true, true, false}},
+        {"advance reuses blocks", []uint64{64, 64 + ReplayWindowSize, 64 + ReplayWindowSize - 1},
+            []bool{true, true, true}},
+    }
+
+    for _, c := range cases {
+        var w ReplayWindow
+
+        for i, counter := range c.counters {
+            if got := w.Accept(counter); got != c.accepted[i] {
+                t.Errorf("%s: counter %d accepted %t, want %t", c.name, counter, got, c.accepted[i])
+            }
+        }
+    }
+}
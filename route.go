@@ -0,0 +1,119 @@
+// longest prefix match over policy destinations
+package main
+
+import (
+    "net"
+    "sort"
+)
+
+/* Binary radix trie keyed on the destination prefix, one per IP version.
+   Each node holds the entries whose destination is exactly that prefix,
+   ordered by longest source prefix first and then by rule order, so a
+   lookup walks down to the longest matching destination and backs up
+   towards the root until an entry also matches the rest of the packet.
+   Tables are built once per policy snapshot and never modified.
+*/
+type RouteTable struct {
+    v4  *routeNode
+    v6  *routeNode
+}
+
+type routeNode struct {
+    child   [2]*routeNode
+    entries []*PolicyEntry
+}
+
+func NewRouteTable(rules []*PolicyEntry) *RouteTable {
+    t := &RouteTable{v4: &routeNode{}, v6: &routeNode{}}
+
+    for _, entry := range rules {
+        dst := entry.Match.dstSubnet
+
+        // entries without a destination match every packet of both versions
+        if dst == nil {
+            t.v4.entries = append(t.v4.entries, entry)
+            t.v6.entries = append(t.v6.entries, entry)
+            continue
+        }
+
+        root := t.v6
+        if len(dst.IP) == net.IPv4len {
+            root = t.v4
+        }
+
+        ones, _ := dst.Mask.Size()
+        node := root
+        for bit := 0; bit < ones; bit++ {
+            next := prefixBit(dst.IP, bit)
+            if node.child[next] == nil {
+                node.child[next] = &routeNode{}
+            }
+
+            node = node.child[next]
+        }
+
+        node.entries = append(node.entries, entry)
+    }
+
+    t.v4.sort()
+    t.v6.sort()
+
+    return t
+}
+
+// order the entries of every node by source prefix length, keeping rule order on ties
+func (n *routeNode) sort() {
+    sort.SliceStable(n.entries, func(i, j int) bool {
+        return sourceLength(n.entries[i]) > sourceLength(n.entries[j])
+    })
+
+    for _, child := range n.child {
+        if child != nil {
+            child.sort()
+        }
+    }
+}
+
+func sourceLength(entry *PolicyEntry) int {
+    if entry.Match.srcSubnet == nil {
+        return -1
+    }
+
+    ones, _ := entry.Match.srcSubnet.Mask.Size()
+    return ones
+}
+
+func prefixBit(ip net.IP, bit int) int {
+    return int(ip[bit / 8] >> (7 - bit % 8)) & 1
+}
+
+// longest prefix match of the packet destination: visit the entries matching pkt, longest destination prefix first, until visit returns true
+func (t *RouteTable) Walk(pkt *Packet, visit func(*PolicyEntry) bool) {
+    var path [129]*routeNode
+
+    root, dst := t.v4, pkt.GetDestination()
+    if pkt.IsIPv6() {
+        root = t.v6
+    } else {
+        dst = dst.To4()
+    }
+
+    depth := 0
+    for node := root; node != nil; depth++ {
+        path[depth] = node
+        if depth == len(dst) * 8 {
+            depth++
+            break
+        }
+
+        node = node.child[prefixBit(dst, depth)]
+    }
+
+    for depth--; depth >= 0; depth-- {
+        for _, entry := range path[depth].entries {
+            if entry.Matches(pkt) && visit(entry) {
+                return
+            }
+        }
+    }
+}
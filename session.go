@@ -0,0 +1,127 @@
+// transport sessions established by the handshake
+package main
+
+import (
+    "crypto/cipher"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    RekeyAfterTime      = 120 * time.Second
+    RekeyAfterBytes     = 1 << 36
+    RejectAfterTime     = 180 * time.Second
+    SessionIdleTimeout  = 90 * time.Second
+    RekeyTimeout        = 5 * time.Second
+    RekeyAttemptTime    = 90 * time.Second
+)
+
+type Session struct {
+    peer         *Peer
+    local        uint32
+    remote       uint32
+    send         cipher.AEAD
+    recv         cipher.AEAD
+    initiator    bool
+    created      time.Time
+    counter      atomic.Uint64
+    lastUsed     atomic.Int64
+    lastSent     atomic.Int64
+    txBytes      atomic.Uint64
+    rxBytes      atomic.Uint64
+    replay       ReplayWindow
+}
+
+func NewSession(peer *Peer, local, remote uint32, send, recv []byte, initiator bool) (*Session, error) {
+    var err error
+
+    s := &Session{peer: peer, local: local, remote: remote, initiator: initiator, created: time.Now()}
+    if s.send, err = newAEAD(send); err != nil {
+        return nil, err
+    }
+
+    if s.recv, err = newAEAD(recv); err != nil {
+        return nil, err
+    }
+
+    s.lastUsed.Store(s.created.UnixNano())
+    s.lastSent.Store(s.created.UnixNano())
+    return s, nil
+}
+
+// seal payload into a data message appended to dst
+func (s *Session) Seal(dst []byte, route Route, payload []byte) ([]byte, error) {
+    return s.seal(dst, MessageData, route, payload)
+}
+
+// seal a probe into a probe message appended to dst
+func (s *Session) SealProbe(dst []byte, probe []byte) ([]byte, error) {
+    return s.seal(dst, MessageProbe, Route{}, probe)
+}
+
+func (s *Session) seal(dst []byte, kind uint8, route Route, payload []byte) ([]byte, error) {
+    var nonce [NonceSize]byte
+
+    counter := s.counter.Add(1) - 1
+    if counter == ^uint64(0) {
+        return nil, ErrCryptoNonceExceeded
+    }
+
+    start := len(dst)
+    dst = appendDataHeader(dst, kind, route, s.remote, counter)
+    makeNonce(nonce[:], s.remote, counter)
+
+    s.txBytes.Add(uint64(len(payload)))
+    s.lastUsed.Store(time.Now().UnixNano())
+    s.lastSent.Store(s.lastUsed.Load())
+
+    return s.send.Seal(dst, nonce[:], payload, dst[start:]), nil
+}
+
+// open a data or probe message into dst, authenticating the header
+func (s *Session) Open(dst []byte, msg []byte) ([]byte, error) {
+    var nonce [NonceSize]byte
+
+    if len(msg) < MessageDataOverhead {
+        return nil, ErrTunnelAuth
+    }
+
+    index, counter := parseDataHeader(msg)
+    makeNonce(nonce[:], index, counter)
+
+    out, err := s.recv.Open(dst, nonce[:], msg[MessageDataHeaderSize:], msg[:MessageDataHeaderSize])
+    if err != nil {
+        return nil, ErrTunnelAuth
+    }
+
+    if !s.replay.Accept(counter) {
+        return nil, ErrTunnelReplay
+    }
+
+    s.rxBytes.Add(uint64(len(out)))
+    s.lastUsed.Store(time.Now().UnixNano())
+
+    return out, nil
+}
+
+// session can no longer be used at all
+func (s *Session) Expired(now time.Time) bool {
+    return now.Sub(s.created) > RejectAfterTime ||
+        now.Sub(time.Unix(0, s.lastUsed.Load())) > SessionIdleTimeout
+}
+
+// nothing was sent on the session for interval
+func (s *Session) Quiet(now time.Time, interval time.Duration) bool {
+    return now.Sub(time.Unix(0, s.lastSent.Load())) >= interval
+}
+
+// session is still usable but a new handshake should be started;
+// the responder waits a little longer so both sides do not rekey at once
+func (s *Session) NeedsRekey(now time.Time) bool {
+    limit := RekeyAfterTime
+    if !s.initiator {
+        limit += 2 * RekeyTimeout
+    }
+
+    return now.Sub(s.created) > limit || s.txBytes.Load() > RekeyAfterBytes
+}
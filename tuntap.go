@@ -1,16 +1,33 @@
 package main
 
 import (
+    "errors"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "syscall"
+    "time"
     "water"
 )
 
+var ErrNetlinkUnsupported = errors.New("Netlink is not supported on this platform")
+
 type TunTap struct {
-    device *water.Interface
-    Name string
+    device  *water.Interface
+    rw      io.ReadWriteCloser
+    netlink *Netlink        // nil when the device is configured by hand
+    index   int
+    mutex   sync.Mutex
+    routes  map[string]*net.IPNet   // installed here, removed on Close
+    Name    string
+    Address *net.IPNet      // with its prefix, nil to leave the device without one
+    MTU     int
 }
 
 func (iface *TunTap) Init() (error) {
     var err error
+    var fd int
 
     config := water.Config{}
     config.Name = iface.Name
@@ -21,11 +38,125 @@ func (iface *TunTap) Init() (error) {
         return err
     }
 
+    iface.rw = iface.device
+
+    if err = iface.configure(); err != nil {
+        return err
+    }
+
+    // water leaves the device in blocking mode, which cannot be interrupted;
+    // a non-blocking duplicate goes through the runtime poller instead
+    file, ok := iface.device.ReadWriteCloser.(*os.File)
+    if !ok {
+        return nil
+    }
+
+    if fd, err = syscall.Dup(int(file.Fd())); err != nil {
+        return err
+    }
+
+    if err = syscall.SetNonblock(fd, true); err != nil {
+        syscall.Close(fd)
+        return err
+    }
+
+    iface.rw = os.NewFile(uintptr(fd), iface.device.Name())
+    iface.device.Close()
+
     return nil
 }
 
+// set the MTU and address of the device and bring it up
+func (iface *TunTap) configure() (error) {
+    var link *net.Interface
+    var err error
+
+    if iface.netlink, err = OpenNetlink(); err == ErrNetlinkUnsupported {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    iface.routes = make(map[string]*net.IPNet)
+
+    if link, err = net.InterfaceByName(iface.device.Name()); err != nil {
+        return err
+    }
+    iface.index = link.Index
+
+    if err = iface.netlink.SetLink(iface.index, iface.MTU); err != nil {
+        return err
+    }
+
+    if iface.Address == nil {
+        return nil
+    }
+
+    return iface.netlink.AddAddress(iface.index, iface.Address)
+}
+
+/* Route each subnet to the device and remove the routes installed for
+   subnets no longer given. A route the kernel already has for a subnet
+   is left to whoever installed it.
+*/
+func (iface *TunTap) SetRoutes(subnets []*net.IPNet) {
+    iface.mutex.Lock()
+    defer iface.mutex.Unlock()
+
+    if iface.netlink == nil {
+        return
+    }
+
+    wanted := make(map[string]*net.IPNet)
+    for _, subnet := range subnets {
+        wanted[subnet.String()] = subnet
+    }
+
+    for key, subnet := range iface.routes {
+        if wanted[key] == nil {
+            Log(iface.netlink.DeleteRoute(iface.index, subnet))
+            delete(iface.routes, key)
+            Print("Route to " + key + " removed")
+        }
+    }
+
+    for key, subnet := range wanted {
+        if iface.routes[key] != nil {
+            continue
+        }
+
+        if err := iface.netlink.AddRoute(iface.index, subnet); err == syscall.EEXIST {
+            Print("Route to " + key + " already present, left as it is")
+            continue
+        } else if err != nil {
+            Print("Cannot route " + key + " to " + iface.Name + ": " + err.Error())
+            continue
+        }
+
+        iface.routes[key] = subnet
+        Print("Route to " + key + " added")
+    }
+}
+
 func (iface *TunTap) Close() (error) {
-    iface.device.Close()
+    iface.SetRoutes(nil)
+
+    iface.mutex.Lock()
+    if iface.netlink != nil {
+        Log(iface.netlink.Close())
+        iface.netlink = nil
+    }
+    iface.mutex.Unlock()
+
+    return iface.rw.Close()
+}
+
+// make a blocked Receive return
+func (iface *TunTap) Interrupt() (error) {
+    if file, ok := iface.rw.(*os.File); ok {
+        return file.SetReadDeadline(time.Now())
+    }
+
     return nil
 }
 
@@ -33,16 +164,18 @@ func (iface *TunTap) Receive(pkt *Packet) (error) {
     var err error
     var n   int
 
-    if n, err = iface.device.Read(pkt.Data); err != nil {
+    if n, err = iface.rw.Read(pkt.Data); err != nil {
         return err
     }
 
     pkt.Size = uint16(n)
+    pkt.Peer = nil
+    pkt.Route = Route{}
 
     return nil
 }
 
 func (iface *TunTap) Send(pkt *Packet) (error) {
-    iface.device.Write(pkt.Data[:pkt.Size])
-    return nil
+    _, err := iface.rw.Write(pkt.Data[:pkt.Size])
+    return err
 }
@@ -3,6 +3,9 @@ package main
 import (
     "net"
     "errors"
+    "strconv"
+    "sync"
+    "time"
 )
 
 var (
@@ -10,12 +13,22 @@ var (
     ErrTunnelSocketClosed = errors.New("udp socket closed")
     ErrTunnelSocketNotReady = errors.New ("Socket is not ready yet")
     ErrTunnelSocketListener = errors.New("Invalid local address")
+    ErrTunnelAuth = errors.New("Tunnel packet failed authentication")
 )
 
 type UDPSocket struct {
     listener    *net.UDPConn
     local       *net.UDPAddr
+    rxBuffer    []byte
+    txBuffers   sync.Pool
+    done        chan struct{}
     LocalSocket string
+    Peers       *Peers
+    ProbeMisses  int
+    ProbeRecover int
+    MTU          int
+    DontFragment bool      // set DF on every datagram, for path MTU discovery
+    Rendezvous   bool      // answer endpoint lookups of peers
 }
 
 // initialize udp tunnel
@@ -25,60 +38,340 @@ func (t *UDPSocket) Init() (error) {
     t.listener = nil
     t.local = nil
 
-    // resolve local address -> ip:port    
-    if t.local, err = net.ResolveUDPAddr("udp4", t.LocalSocket); err != nil {
+    // peers may have a larger MTU than this node
+    t.rxBuffer = make([]byte, MaxPacketSize)
+    t.txBuffers.New = func() any {
+        buffer := make([]byte, 0, t.MTU + MessageDataOverhead)
+        return &buffer
+    }
+
+    // resolve local address -> ip:port, either IPv4 or IPv6;
+    // a wildcard address listens on both
+    if t.local, err = net.ResolveUDPAddr("udp", t.LocalSocket); err != nil {
         return err
     }
 
     // listen on local ip:port
-    if t.listener, err = net.ListenUDP("udp4", t.local); err != nil {
+    if t.listener, err = net.ListenUDP("udp", t.local); err != nil {
         return err
     }
 
+    if t.DontFragment {
+        if err = setDontFragment(t.listener); err != nil {
+            return err
+        }
+    }
+
+    t.done = make(chan struct{})
+    go t.maintain()
+
     return nil
 }
 
 // close udp tunnel
 func (t *UDPSocket) Close() (error) {
+    close(t.done)
     t.listener.Close()
     return nil
 }
 
-// receive packet from remote peer
+// make a blocked Receive return
+func (t *UDPSocket) Interrupt() (error) {
+    return t.listener.SetReadDeadline(time.Now())
+}
+
+// retransmit handshakes, expire sessions and send persistent keepalives
+func (t *UDPSocket) maintain() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-t.done:
+            return
+        case now := <-ticker.C:
+            retransmit, keepalives := t.Peers.Maintain(now)
+            for peer, msg := range retransmit {
+                t.listener.WriteToUDP(msg, peer.Endpoint())
+            }
+
+            for _, session := range keepalives {
+                t.write(session, Route{}, nil)
+            }
+        }
+    }
+}
+
+/* Receive packet from remote peer
+   Handshake messages are answered here and never reach the engine,
+   so this only returns once a data packet has been authenticated.
+*/
 func (t *UDPSocket) Receive(pkt *Packet) (error) {
     var err error
     var n int
+    var addr *net.UDPAddr
+    var payload []byte
 
     if t.listener == nil {
         return ErrTunnelSocketNotReady
     }
 
-    // read packet from udp tunnel
-    if n, _, err = t.listener.ReadFromUDP(pkt.Data); err != nil {
-        return ErrTunnelSocketRX
+    for {
+        // read packet from udp tunnel
+        if n, addr, err = t.listener.ReadFromUDP(t.rxBuffer); err != nil {
+            return ErrTunnelSocketRX
+        }
+
+        if n == 0 {
+            return ErrTunnelSocketClosed
+        }
+
+        msg := t.rxBuffer[:n]
+
+        switch msg[0] {
+        case MessageInitiation:
+            if err = t.handleInitiation(msg, addr); err != nil {
+                return ErrTunnelAuth
+            }
+            continue
+
+        case MessageResponse:
+            if err = t.handleResponse(msg, addr); err != nil {
+                return ErrTunnelAuth
+            }
+            continue
+
+        case MessageData, MessageProbe:
+        default:
+            return ErrTunnelAuth
+        }
+
+        session := t.Peers.Session(msg)
+        if session == nil || len(msg) < MessageDataOverhead {
+            return ErrTunnelAuth
+        }
+
+        // authenticate and decrypt into the packet buffer
+        if payload, err = session.Open(pkt.Data[:0], msg); err != nil {
+            return err
+        }
+
+        t.Peers.Confirm(session)
+        session.peer.Roam(addr)
+
+        if msg[0] == MessageProbe {
+            if len(payload) < ProbeSize {
+                return ErrTunnelAuth
+            }
+
+            t.handleProbe(session, payload)
+            continue
+        }
+
+        // empty payloads only keep the session alive
+        if len(payload) == 0 {
+            continue
+        }
+
+        pkt.Size = uint16(len(payload))
+        pkt.Peer = session.peer
+        pkt.Route = parseRoute(msg)
+        return nil
+    }
+}
+
+func (t *UDPSocket) handleInitiation(msg []byte, addr *net.UDPAddr) (error) {
+    var response []byte
+    var err error
+
+    if _, response, err = t.Peers.ConsumeInitiation(msg, addr); err != nil {
+        return err
     }
 
-    if n == 0 {
-        return ErrTunnelSocketClosed
+    _, err = t.listener.WriteToUDP(response, addr)
+    return err
+}
+
+// a completed handshake flushes the packets queued for the peer,
+// or confirms the session with a keepalive if there are none
+func (t *UDPSocket) handleResponse(msg []byte, addr *net.UDPAddr) (error) {
+    var peer *Peer
+    var session *Session
+    var err error
+
+    if peer, session, err = t.Peers.ConsumeResponse(msg); err != nil {
+        return err
     }
 
-    pkt.Size = uint16(n)
+    peer.Roam(addr)
+
+    queue := peer.Dequeue()
+    if len(queue) == 0 {
+        return t.write(session, Route{}, nil)
+    }
+
+    for _, packet := range queue {
+        if err = t.write(session, packet.route, packet.data); err != nil {
+            return err
+        }
+    }
 
     return nil
 }
 
-// send packet to remote peer
-func (t *UDPSocket) Send(pkt *Packet) (error) {
+/* Send the next liveness probe to peer
+   Without a session a handshake is started instead, and the probe counts
+   as missed, so a peer that never answers fails all the same. A missed
+   probe also starts a handshake, in case the peer lost its session.
+   A peer without an endpoint cannot be probed and misses every probe.
+   Returns whether the peer just failed.
+*/
+func (t *UDPSocket) SendProbe(peer *Peer) (bool, error) {
+    var msg []byte
+    var err error
+
+    sequence, missed, failed := peer.nextProbe(t.ProbeMisses)
+    if peer.Endpoint() == nil {
+        return failed, nil
+    }
+
+    session := peer.Session()
+    if session == nil || missed > 0 || session.NeedsRekey(time.Now()) {
+        if msg, err = t.Peers.Initiate(peer, time.Now()); err != nil || msg == nil {
+            return failed, err
+        }
+
+        if _, err = t.listener.WriteToUDP(msg, peer.Endpoint()); err != nil || session == nil {
+            return failed, err
+        }
+    }
+
+    return failed, t.writeProbe(session, ProbeRequest, sequence, nil, 0)
+}
+
+// answer probe requests and account for replies
+func (t *UDPSocket) handleProbe(session *Session, payload []byte) {
+    kind, sequence := parseProbe(payload)
+    body := payload[ProbeSize:]
+
+    switch kind {
+    case ProbeRequest:
+        Log(t.writeProbe(session, ProbeReply, sequence, nil, 0))
+    case ProbeReply:
+        if session.peer.probeAnswered(sequence, t.ProbeRecover) {
+            Print("Peer " + session.peer.String() + " is up, " + strconv.Itoa(t.ProbeRecover) + " probes answered")
+        }
+    case ProbeMTURequest:
+        Log(t.writeProbe(session, ProbeMTUReply, sequence, nil, 0))
+    case ProbeMTUReply:
+        session.peer.mtuProbeAnswered(sequence)
+    case ProbeRendezvousRequest:
+        t.handleRendezvousRequest(session, sequence, body)
+    case ProbeRendezvousReply:
+        t.handleRendezvousReply(session, body)
+    }
+}
+
+// seal a probe with body, padded to size for path MTU probes, and send it to the peer
+func (t *UDPSocket) writeProbe(session *Session, kind uint8, sequence uint64, body []byte, size int) (error) {
+    var small [ProbeSize + KeySize + EndpointSize]byte
+    var msg []byte
     var err error
 
+    buffer := t.txBuffers.Get().(*[]byte)
+    defer t.txBuffers.Put(buffer)
+
+    probe := append(appendProbe(small[:0], kind, sequence), body...)
+    if size > len(probe) {
+        probe = append(probe, make([]byte, size - len(probe))...)
+    }
+
+    if msg, err = session.SealProbe((*buffer)[:0], probe); err != nil {
+        return err
+    }
+
+    _, err = t.listener.WriteToUDP(msg, session.peer.Endpoint())
+    return err
+}
+
+// seal data with session and send it to the peer endpoint
+func (t *UDPSocket) write(session *Session, route Route, data []byte) (error) {
+    var err error
+    var msg []byte
+
+    // both forwarding loops send to the tunnel, so each send borrows a buffer
+    buffer := t.txBuffers.Get().(*[]byte)
+    defer t.txBuffers.Put(buffer)
+
+    if msg, err = session.Seal((*buffer)[:0], route, data); err != nil {
+        return err
+    }
+
+    _, err = t.listener.WriteToUDP(msg, session.peer.Endpoint())
+    return err
+}
+
+// send packet to remote peer, queueing it while a handshake is in progress
+func (t *UDPSocket) Send(pkt *Packet) (error) {
     if t.listener == nil {
        return ErrTunnelSocketNotReady
     }
 
-    // send packet to udp tunnel
-    if _, err = t.listener.WriteToUDP(pkt.Data[:pkt.Size], pkt.Endpoint); err != nil {
-        return err
+    peer := pkt.Target
+    if peer == nil {
+        return ErrPeerUnknown
+    }
+
+    return t.send(peer, pkt.Data[:pkt.Size], pkt.Route, true)
+}
+
+/* Seal data for peer, starting a handshake when there is no fresh session
+   Without a session data goes through the relay of the peer, if it has one
+   and relaying is allowed, and is queued for the handshake otherwise.
+*/
+func (t *UDPSocket) send(peer *Peer, data []byte, route Route, relay bool) (error) {
+    var msg []byte
+    var err error
+
+    now := time.Now()
+    endpoint := peer.Endpoint()
+
+    session := peer.Session()
+    if endpoint != nil && (session == nil || session.NeedsRekey(now)) {
+        if msg, err = t.Peers.Initiate(peer, now); err != nil {
+            return err
+        }
+
+        if msg != nil {
+            t.listener.WriteToUDP(msg, endpoint)
+        }
+    }
+
+    if session != nil {
+        return t.write(session, route, data)
     }
 
+    if via := t.Peers.Relay(peer); relay && via != nil {
+        return t.send(via, data, route, false)
+    }
+
+    if endpoint == nil {
+        return ErrPeerNoEndpoint
+    }
+
+    peer.Enqueue(data, route)
     return nil
 }
+
+// send a handshake initiation to open the NAT mappings towards peer
+func (t *UDPSocket) Punch(peer *Peer) (error) {
+    var msg []byte
+    var err error
+
+    if msg, err = t.Peers.Initiate(peer, time.Now()); err != nil || msg == nil {
+        return err
+    }
+
+    _, err = t.listener.WriteToUDP(msg, peer.Endpoint())
+    return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "net"
+    "syscall"
+)
+
+// set DF on every datagram, ignoring the path MTU known to the kernel, so
+// that probes too big for the path are lost instead of being fragmented
+func setDontFragment(conn *net.UDPConn) (error) {
+    var err4, err6 error
+
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return err
+    }
+
+    // a socket bound to a wildcard address carries both IP versions
+    err = raw.Control(func(fd uintptr) {
+        err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+        err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+    })
+
+    if err != nil {
+        return err
+    }
+
+    if err4 != nil && err6 != nil {
+        return err4
+    }
+
+    return nil
+}
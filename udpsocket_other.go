@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "net"
+)
+
+var ErrDontFragment = errors.New("Path MTU discovery is only supported on Linux")
+
+func setDontFragment(conn *net.UDPConn) (error) {
+    return ErrDontFragment
+}